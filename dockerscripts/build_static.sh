@@ -18,6 +18,6 @@ cd /tmp/libvirt-${libvirt_ver}/build
     sed -i 's/^Libs:.*/& -lnl -ltirpc -lxml2/' /usr/local/lib/pkgconfig/libvirt.pc
 cd /usr/src/libvirt_exporter
 echo build go binary
-go build --ldflags '-extldflags "-static"' -o libvirt_exporter
+go build --ldflags "-extldflags '-static' -X main.version=$(git describe --tags --always 2>/dev/null || echo unknown)" -o libvirt_exporter
 echo strip go binary
 strip libvirt_exporter
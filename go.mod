@@ -1,9 +1,11 @@
 module github.com/g00g1/libvirt_exporter
 
-go 1.18
+go 1.19
 
 require (
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/prometheus/client_golang v1.18.0
+	github.com/prometheus/client_model v0.5.0
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
 	libvirt.org/go/libvirt v1.9008.0
 )
@@ -13,8 +15,8 @@ require (
 	github.com/alecthomas/units v0.0.0-20231202071711-9a357b53e9c9 // indirect
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/matttproud/golang_protobuf_extensions/v2 v2.0.0 // indirect
-	github.com/prometheus/client_model v0.5.0 // indirect
 	github.com/prometheus/common v0.45.0 // indirect
 	github.com/prometheus/procfs v0.12.0 // indirect
 	golang.org/x/sys v0.16.0 // indirect
@@ -16,216 +16,999 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"hash/maphash"
+	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/g00g1/libvirt_exporter/libvirt_schema"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/graphite"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"libvirt.org/go/libvirt"
 )
 
-var (
-	libvirtUpDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "", "up"),
-		"Whether scraping libvirt's metrics was successful.",
+// metrics holds the descriptors of all exported metrics, built by newMetrics under
+// the namespace of the exporter.
+type metrics struct {
+	libvirtUpDesc               *prometheus.Desc
+	libvirtScrapesInFlightDesc  *prometheus.Desc
+	libvirtScrapesTotalDesc     *prometheus.Desc
+	libvirtDomainsFailedDesc    *prometheus.Desc
+	libvirtDomainsActiveDesc    *prometheus.Desc
+	libvirtDomainsInactiveDesc  *prometheus.Desc
+	libvirtDomainsTruncatedDesc *prometheus.Desc
+	libvirtCollectorErrorsDesc  *prometheus.Desc
+	libvirtLastScrapeTimeDesc   *prometheus.Desc
+
+	libvirtConnectionReconnectsDesc      *prometheus.Desc
+	libvirtConnectionConnectDurationDesc *prometheus.Desc
+	libvirtConnectionHealthyDesc         *prometheus.Desc
+	libvirtConnectionLastHealthyDesc     *prometheus.Desc
+	libvirtConnectionReadOnlyDesc        *prometheus.Desc
+	libvirtConnectionFailuresDesc        *prometheus.Desc
+
+	libvirtRPCGetAllDomainStatsDurationDesc *prometheus.Desc
+
+	libvirtNodeMemoryDesc               *prometheus.Desc
+	libvirtNodeCPUsDesc                 *prometheus.Desc
+	libvirtNodeDomainAssignedMemoryDesc *prometheus.Desc
+	libvirtNodeDomainAssignedVcpusDesc  *prometheus.Desc
+
+	libvirtNodeCPUFrequencyDesc *prometheus.Desc
+
+	libvirtNodeDomainCapsMaxVcpusDesc *prometheus.Desc
+	libvirtNodeMachineTypeInfoDesc    *prometheus.Desc
+
+	libvirtNodeActiveMigrationsDesc *prometheus.Desc
+	libvirtNodeDomainsByStateDesc   *prometheus.Desc
+
+	libvirtDomainInfoMaxMemDesc        *prometheus.Desc
+	libvirtDomainInfoMemoryUsageDesc   *prometheus.Desc
+	libvirtDomainInfoNrVirtCPUDesc     *prometheus.Desc
+	libvirtDomainInfoCPUTimeDesc       *prometheus.Desc
+	libvirtDomainInfoCPUUserTimeDesc   *prometheus.Desc
+	libvirtDomainInfoCPUSystemTimeDesc *prometheus.Desc
+	libvirtDomainInfoVirDomainState    *prometheus.Desc
+	libvirtDomainCPUUsagePercentDesc   *prometheus.Desc
+	libvirtDomainStateSinceDesc        *prometheus.Desc
+	libvirtDomainMetadataDesc          *prometheus.Desc
+
+	libvirtDomainCPUModelInfoDesc     *prometheus.Desc
+	libvirtDomainCPUFeatureDesc       *prometheus.Desc
+	libvirtDomainCPUTopologyInfoDesc  *prometheus.Desc
+	libvirtDomainCPUTopologyVcpusDesc *prometheus.Desc
+	libvirtDomainNestedVirtDesc       *prometheus.Desc
+
+	libvirtDomainGraphicsInfoDesc *prometheus.Desc
+	libvirtDomainGraphicsPortDesc *prometheus.Desc
+
+	libvirtDomainHostdevInfoDesc *prometheus.Desc
+
+	libvirtDomainDescriptionInfoDesc *prometheus.Desc
+	libvirtDomainEmulatorInfoDesc    *prometheus.Desc
+
+	libvirtDomainAgentConnectedDesc *prometheus.Desc
+
+	libvirtDomainRNGInfoDesc *prometheus.Desc
+
+	libvirtDomainVideoInfoDesc      *prometheus.Desc
+	libvirtDomainVideoVRAMBytesDesc *prometheus.Desc
+
+	libvirtDomainBootOrderInfoDesc *prometheus.Desc
+
+	libvirtDomainBlkioWeightDesc       *prometheus.Desc
+	libvirtDomainBlkioDeviceWeightDesc *prometheus.Desc
+
+	libvirtDomainMemtuneHardLimitDesc     *prometheus.Desc
+	libvirtDomainMemtuneSoftLimitDesc     *prometheus.Desc
+	libvirtDomainMemtuneSwapHardLimitDesc *prometheus.Desc
+	libvirtDomainMemoryLockedDesc         *prometheus.Desc
+
+	libvirtDomainNumatuneInfoDesc        *prometheus.Desc
+	libvirtDomainNumatuneMemnodeInfoDesc *prometheus.Desc
+	libvirtDomainHugepageBackingInfoDesc *prometheus.Desc
+	libvirtDomainHugepagePageSizeDesc    *prometheus.Desc
+
+	libvirtDomainTPMInfoDesc           *prometheus.Desc
+	libvirtDomainSecureBootEnabledDesc *prometheus.Desc
+	libvirtDomainSEVEnabledDesc        *prometheus.Desc
+	libvirtDomainSEVInfoDesc           *prometheus.Desc
+
+	libvirtDomainCacheOccupancyDesc       *prometheus.Desc
+	libvirtDomainMemoryBandwidthTotalDesc *prometheus.Desc
+	libvirtDomainMemoryBandwidthLocalDesc *prometheus.Desc
+
+	// Deprecated metrics, only exported with --compat.legacy-metrics
+	libvirtLegacyDomainMemoryBandwidthTotalDesc *prometheus.Desc
+	libvirtLegacyDomainMemoryBandwidthLocalDesc *prometheus.Desc
+	libvirtLegacyDomainBlockRdTotalTimesDesc    *prometheus.Desc
+
+	libvirtDomainBlockRdBytesDesc           *prometheus.Desc
+	libvirtDomainBlockRdReqDesc             *prometheus.Desc
+	libvirtDomainBlockRdTotalTimesDesc      *prometheus.Desc
+	libvirtDomainBlockWrBytesDesc           *prometheus.Desc
+	libvirtDomainBlockWrReqDesc             *prometheus.Desc
+	libvirtDomainBlockWrTotalTimesDesc      *prometheus.Desc
+	libvirtDomainBlockFlushReqDesc          *prometheus.Desc
+	libvirtDomainBlockFlushTotalTimesDesc   *prometheus.Desc
+	libvirtDomainBlockAllocationDesc        *prometheus.Desc
+	libvirtDomainBlockBackingCapacityDesc   *prometheus.Desc
+	libvirtDomainBlockCapacityDesc          *prometheus.Desc
+	libvirtDomainBlockPhysicalSizeDesc      *prometheus.Desc
+	libvirtDomainBlockOvercommitDesc        *prometheus.Desc
+	libvirtDomainBlockBackingChainDepthDesc *prometheus.Desc
+	libvirtDomainBlockDriverInfoDesc        *prometheus.Desc
+	libvirtDomainBlockInfoDesc              *prometheus.Desc
+	libvirtDomainBlockFlagsInfoDesc         *prometheus.Desc
+	libvirtDomainBlockTotalRequestsDesc     *prometheus.Desc
+	libvirtDomainBlockTotalBytesDesc        *prometheus.Desc
+	libvirtDomainBlockLogicalBlockSizeDesc  *prometheus.Desc
+	libvirtDomainBlockPhysicalBlockSizeDesc *prometheus.Desc
+	libvirtDomainBlockRdMergesDesc          *prometheus.Desc
+	libvirtDomainBlockWrMergesDesc          *prometheus.Desc
+	libvirtDomainBlockIdleTimeDesc          *prometheus.Desc
+	libvirtDomainBlockInvalidRdReqDesc      *prometheus.Desc
+	libvirtDomainBlockInvalidWrReqDesc      *prometheus.Desc
+	libvirtDomainBlockInvalidFlushReqDesc   *prometheus.Desc
+	libvirtDomainBlockRdLatencyDesc         *prometheus.Desc
+	libvirtDomainBlockWrLatencyDesc         *prometheus.Desc
+	libvirtDomainBlockFlushLatencyDesc      *prometheus.Desc
+
+	libvirtDomainBlockJobCurDesc  *prometheus.Desc
+	libvirtDomainBlockJobEndDesc  *prometheus.Desc
+	libvirtDomainBlockJobTypeDesc *prometheus.Desc
+
+	libvirtDomainInterfaceRxBytesDesc   *prometheus.Desc
+	libvirtDomainInterfaceRxPacketsDesc *prometheus.Desc
+	libvirtDomainInterfaceRxErrsDesc    *prometheus.Desc
+	libvirtDomainInterfaceRxDropDesc    *prometheus.Desc
+	libvirtDomainInterfaceTxBytesDesc   *prometheus.Desc
+	libvirtDomainInterfaceTxPacketsDesc *prometheus.Desc
+	libvirtDomainInterfaceTxErrsDesc    *prometheus.Desc
+	libvirtDomainInterfaceTxDropDesc    *prometheus.Desc
+	libvirtDomainInterfaceLinkUpDesc    *prometheus.Desc
+	libvirtDomainInterfaceVhostuserDesc *prometheus.Desc
+
+	libvirtDomainMemoryStatMajorfaultDesc     *prometheus.Desc
+	libvirtDomainMemoryStatMinorFaultDesc     *prometheus.Desc
+	libvirtDomainMemoryStatUnusedDesc         *prometheus.Desc
+	libvirtDomainMemoryStatAvailableDesc      *prometheus.Desc
+	libvirtDomainMemoryStatActualBaloonDesc   *prometheus.Desc
+	libvirtDomainMemoryStatRssDesc            *prometheus.Desc
+	libvirtDomainMemoryStatUsableDesc         *prometheus.Desc
+	libvirtDomainMemoryStatDiskCachesDesc     *prometheus.Desc
+	libvirtDomainMemoryStatSwapInDesc         *prometheus.Desc
+	libvirtDomainMemoryStatSwapOutDesc        *prometheus.Desc
+	libvirtDomainMemoryStatHugetlbPgAllocDesc *prometheus.Desc
+	libvirtDomainMemoryStatHugetlbPgFailDesc  *prometheus.Desc
+	libvirtDomainMemoryStatUsedPercentDesc    *prometheus.Desc
+	libvirtDomainMemoryStatReportedDesc       *prometheus.Desc
+	libvirtDomainBalloonDeflateStuckDesc      *prometheus.Desc
+	libvirtDomainConfigHashDesc               *prometheus.Desc
+
+	libvirtDomainDirtyRateDesc *prometheus.Desc
+
+	libvirtDomainInfoCPUStealTimeDesc *prometheus.Desc
+	libvirtDomainVcpuNumaNodeDesc     *prometheus.Desc
+
+	libvirtDomainQemuProcessRssDesc     *prometheus.Desc
+	libvirtDomainQemuProcessThreadsDesc *prometheus.Desc
+
+	libvirtDomainVcpuHaltPollSuccessDesc *prometheus.Desc
+	libvirtDomainVcpuHaltWakeupDesc      *prometheus.Desc
+
+	libvirtDomainWatchdogEventsDesc *prometheus.Desc
+	libvirtDomainPanicEventsDesc    *prometheus.Desc
+}
+
+// newMetrics builds the descriptors of all exported metrics under the given
+// namespace, with the metadata labels on the metadata metric.
+func newMetrics(namespace string, metadataLabels []MetadataLabel) *metrics {
+	m := &metrics{}
+
+	m.libvirtUpDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "up"),
+		"Whether scraping libvirt's metrics was successful, with the URI of libvirt without credentials.",
+		[]string{"uri"},
+		nil)
+	m.libvirtScrapesInFlightDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "scrapes_in_flight"),
+		"Number of scrapes of libvirt's metrics currently in progress.",
+		nil,
+		nil)
+	m.libvirtScrapesTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "scrapes_total"),
+		"Total number of scrapes of libvirt's metrics.",
+		nil,
+		nil)
+	m.libvirtDomainsFailedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "domains_failed"),
+		"Number of domains whose metrics could not be collected during the scrape.",
+		nil,
+		nil)
+	m.libvirtDomainsActiveDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "domains_active"),
+		"Number of active (not shut off) domains.",
+		nil,
+		nil)
+	m.libvirtDomainsInactiveDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "domains_inactive"),
+		"Number of inactive (shut off) domains.",
+		nil,
+		nil)
+	m.libvirtDomainsTruncatedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "domains_truncated_total"),
+		"Number of domains left out of the scrapes because of --collector.max-domains.",
+		nil,
+		nil)
+	m.libvirtCollectorErrorsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "collector", "errors_total"),
+		"Number of errors of a collector which didn't fail the whole domain, such as unreadable steal time.",
+		[]string{"type"},
+		nil)
+	m.libvirtLastScrapeTimeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "last_scrape_timestamp_seconds"),
+		"Time at which the metrics were last collected from libvirt in the background, in seconds since the epoch.",
+		nil,
+		nil)
+
+	m.libvirtConnectionReconnectsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "connection", "reconnects_total"),
+		"Number of times the connection to libvirt had to be re-established.",
+		nil,
+		nil)
+	m.libvirtConnectionConnectDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "connection", "connect_duration_seconds"),
+		"Time taken by the last attempt to connect to libvirt, in seconds.",
+		nil,
+		nil)
+	m.libvirtConnectionHealthyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "connection", "healthy"),
+		"Whether libvirt answered the last health check of the connection.",
+		nil,
+		nil)
+	m.libvirtConnectionLastHealthyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "connection", "last_healthy_timestamp_seconds"),
+		"Time of the last health check libvirt answered, in seconds since the Unix epoch.",
+		nil,
+		nil)
+	m.libvirtConnectionReadOnlyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "connection", "readonly"),
+		"Whether the connection to libvirt is read-only, in which case the steal time isn't collected.",
+		nil,
+		nil)
+	m.libvirtConnectionFailuresDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "connection", "failures_total"),
+		"Number of failed attempts to connect to libvirt, by reason (tls, auth or connect).",
+		[]string{"reason"},
+		nil)
+
+	m.libvirtRPCGetAllDomainStatsDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "rpc", "get_all_domain_stats_duration_seconds"),
+		"Time taken by the call to libvirt fetching the statistics of all domains during the scrape, in seconds.",
+		nil,
+		nil)
+
+	m.libvirtNodeMemoryDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "node", "memory_bytes"),
+		"Physical memory of the host, in bytes.",
+		nil,
+		nil)
+	m.libvirtNodeCPUsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "node", "cpus"),
+		"Number of active physical CPUs of the host.",
+		nil,
+		nil)
+	m.libvirtNodeCPUFrequencyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "node", "cpu_frequency_hertz"),
+		"Current frequency of a CPU of the host, as read from the cpufreq sysfs.",
+		[]string{"cpu"},
+		nil)
+	m.libvirtNodeDomainAssignedMemoryDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "node", "domain_assigned_memory_bytes"),
+		"Sum of the maximum memory of the active domains, in bytes.",
+		nil,
+		nil)
+	m.libvirtNodeDomainAssignedVcpusDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "node", "domain_assigned_vcpus"),
+		"Sum of the online vCPUs of the active domains.",
 		nil,
 		nil)
 
-	libvirtDomainInfoMaxMemDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_info", "maximum_memory_bytes"),
+	m.libvirtNodeDomainCapsMaxVcpusDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "node", "domain_caps_max_vcpus"),
+		"Maximum number of vCPUs of a domain using the default emulator and machine type of the host.",
+		[]string{"arch", "machine", "virt_type"},
+		nil)
+	m.libvirtNodeMachineTypeInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "node", "machine_type_info"),
+		"Machine type supported by the host for the given guest architecture.",
+		[]string{"arch", "machine"},
+		nil)
+
+	m.libvirtNodeDomainsByStateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "node", "domains_by_state"),
+		"Number of domains in each state, as in libvirt_domain_info_vstate: nostate (0), running (1), blocked (2), paused (3), shutdown (4), shutoff (5), crashed (6), pmsuspended (7).",
+		[]string{"state"},
+		nil)
+	m.libvirtNodeActiveMigrationsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "node", "active_migrations"),
+		"Number of domains being migrated to (in) or from (out) the host.",
+		[]string{"direction"},
+		nil)
+
+	m.libvirtDomainInfoMaxMemDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_info", "maximum_memory_bytes"),
 		"Maximum allowed memory of the domain, in bytes.",
 		[]string{"domain"},
 		nil)
-	libvirtDomainInfoMemoryUsageDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_info", "memory_usage_bytes"),
+	m.libvirtDomainInfoMemoryUsageDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_info", "memory_usage_bytes"),
 		"Memory usage of the domain, in bytes.",
 		[]string{"domain"},
 		nil)
-	libvirtDomainInfoNrVirtCPUDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_info", "virtual_cpus"),
+	m.libvirtDomainInfoNrVirtCPUDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_info", "virtual_cpus"),
 		"Number of virtual CPUs for the domain.",
 		[]string{"domain"},
 		nil)
-	libvirtDomainInfoCPUTimeDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_info", "cpu_time_seconds_total"),
+	m.libvirtDomainInfoCPUTimeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_info", "cpu_time_seconds_total"),
 		"Amount of CPU time used by the domain, in seconds.",
 		[]string{"domain"},
 		nil)
-	libvirtDomainInfoVirDomainState = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_info", "vstate"),
+	m.libvirtDomainInfoCPUUserTimeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_info", "cpu_user_seconds_total"),
+		"Amount of CPU time spent by the domain in user mode, running the guest and QEMU itself, in seconds.",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainInfoCPUSystemTimeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_info", "cpu_system_seconds_total"),
+		"Amount of CPU time spent by the domain in the host kernel, in seconds.",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainInfoVirDomainState = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_info", "vstate"),
 		"Virtual domain state. 0: no state, 1: the domain is running, 2: the domain is blocked on resource,"+
 			" 3: the domain is paused by user, 4: the domain is being shut down, 5: the domain is shut off,"+
 			"6: the domain is crashed, 7: the domain is suspended by guest power management",
 		[]string{"domain"},
 		nil)
+	m.libvirtDomainCPUUsagePercentDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "cpu_usage_percent"),
+		"CPU usage of the domain since the previous scrape, in percent of its virtual CPUs.",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainStateSinceDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "state_since_timestamp_seconds"),
+		"Time at which the exporter first saw the domain in its current state, in seconds since the epoch.",
+		[]string{"domain"},
+		nil)
+
+	metadataLabelNames := []string{"domain"}
+	for _, label := range metadataLabels {
+		metadataLabelNames = append(metadataLabelNames, label.Name)
+	}
+
+	m.libvirtDomainMetadataDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "metadata"),
+		"Metadata of the domain, as configured with --libvirt.metadata-labels.",
+		metadataLabelNames,
+		nil)
+
+	m.libvirtDomainCPUModelInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "cpu_model_info"),
+		"CPU mode and model advertised to the domain.",
+		[]string{"domain", "mode", "model"},
+		nil)
+	m.libvirtDomainCPUFeatureDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "cpu_feature"),
+		"CPU feature explicitly configured for the domain, with its policy.",
+		[]string{"domain", "feature", "policy"},
+		nil)
+	m.libvirtDomainNestedVirtDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "nested_virt_enabled"),
+		"Whether the vmx or svm CPU feature, for nested virtualization, is explicitly enabled for the domain.",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainCPUTopologyInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "cpu_topology_info"),
+		"CPU topology explicitly configured for the domain.",
+		[]string{"domain", "sockets", "cores", "threads"},
+		nil)
+	m.libvirtDomainCPUTopologyVcpusDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "cpu_topology_vcpus"),
+		"Number of vCPUs of the CPU topology explicitly configured for the domain.",
+		[]string{"domain"},
+		nil)
+
+	m.libvirtDomainGraphicsInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "graphics_info"),
+		"Graphical console (VNC, SPICE, ...) configured for the domain.",
+		[]string{"domain", "type"},
+		nil)
+	m.libvirtDomainGraphicsPortDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "graphics_port"),
+		"TCP port of the graphical console of the domain, only known once it is allocated.",
+		[]string{"domain", "type"},
+		nil)
+
+	m.libvirtDomainHostdevInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "hostdev_info"),
+		"Host device assigned to the domain, identified by its PCI address or mediated device UUID.",
+		[]string{"domain", "type", "address"},
+		nil)
+
+	m.libvirtDomainDescriptionInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "description_info"),
+		"Title and description of the domain, the description being truncated to 256 characters.",
+		[]string{"domain", "title", "description"},
+		nil)
+	m.libvirtDomainEmulatorInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "emulator_info"),
+		"Emulator binary running the domain, with the type of the domain (kvm, qemu, ...).",
+		[]string{"domain", "emulator_path", "type"},
+		nil)
+
+	m.libvirtDomainAgentConnectedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "agent_connected"),
+		"Whether the QEMU guest agent is connected to its channel, only known for the running domains.",
+		[]string{"domain"},
+		nil)
+
+	m.libvirtDomainRNGInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "rng_info"),
+		"Random number generator device of the domain, with its backend (random, egd, builtin) and the source of the entropy: the host device for the random backend, the character device type for egd.",
+		[]string{"domain", "model", "backend", "source"},
+		nil)
+
+	m.libvirtDomainVideoInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "video_info"),
+		"Video device of the domain, by its position among the video devices of the domain XML.",
+		[]string{"domain", "index", "model", "heads"},
+		nil)
+	m.libvirtDomainVideoVRAMBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "video_vram_bytes"),
+		"Video memory of a video device of the domain, in bytes.",
+		[]string{"domain", "index"},
+		nil)
+	m.libvirtDomainBootOrderInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "boot_order_info"),
+		"Boot device of the domain with its position in the boot order, either a device type (hd, cdrom, network, fd) or the target device or address of a disk, interface or host device.",
+		[]string{"domain", "device", "order"},
+		nil)
+
+	m.libvirtDomainBlkioWeightDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "blkio_weight"),
+		"Proportional weight of the block I/O of the domain.",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainBlkioDeviceWeightDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "blkio_device_weight"),
+		"Proportional weight of the block I/O of the domain on a host device.",
+		[]string{"domain", "device"},
+		nil)
+	m.libvirtDomainMemtuneHardLimitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "memtune_hard_limit_bytes"),
+		"Maximum memory the domain can use on the host, in bytes. Absent when unlimited.",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainMemtuneSoftLimitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "memtune_soft_limit_bytes"),
+		"Memory the domain is limited to under memory contention on the host, in bytes. Absent when unlimited.",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainMemtuneSwapHardLimitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "memtune_swap_hard_limit_bytes"),
+		"Maximum memory plus swap the domain can use on the host, in bytes. Absent when unlimited.",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainMemoryLockedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "memory_locked"),
+		"Whether the memory of the domain is locked in the host memory, never swapped out.",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainNumatuneInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "numatune_info"),
+		"Host NUMA nodes the memory of the domain is allocated from, and how (strict, interleave, preferred, restrictive).",
+		[]string{"domain", "mode", "nodeset"},
+		nil)
+	m.libvirtDomainNumatuneMemnodeInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "numatune_memnode_info"),
+		"Host NUMA nodes the memory of a guest NUMA node of the domain is allocated from, and how.",
+		[]string{"domain", "cellid", "mode", "nodeset"},
+		nil)
+	m.libvirtDomainHugepageBackingInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "hugepage_backing_info"),
+		"Size in bytes of the hugepages backing the memory of the domain, \"default\" for the default hugepage size of the host.",
+		[]string{"domain", "size"},
+		nil)
+	m.libvirtDomainHugepagePageSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "hugepage_page_size_bytes"),
+		"Largest size of the hugepages explicitly configured to back the memory of the domain.",
+		[]string{"domain"},
+		nil)
+
+	m.libvirtDomainTPMInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "tpm_info"),
+		"TPM device of the domain, with its backend (emulator or passthrough) and TPM version.",
+		[]string{"domain", "model", "backend", "version"},
+		nil)
+	m.libvirtDomainSecureBootEnabledDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "secureboot_enabled"),
+		"Whether the domain boots with UEFI Secure Boot enforced, per the secure-boot and enrolled-keys features of its firmware.",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainSEVEnabledDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "sev_enabled"),
+		"Whether the memory of the domain is encrypted with AMD SEV.",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainSEVInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "sev_info"),
+		"AMD SEV launch measurement and policy of a running domain, and the SEV firmware API version.",
+		[]string{"domain", "measurement", "policy", "api_version"},
+		nil)
+
+	m.libvirtDomainCacheOccupancyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "cache_occupancy_bytes"),
+		"Last level cache used by the domain, in bytes (Intel RDT CMT perf event).",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainMemoryBandwidthTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "memory_bandwidth_total_bytes_total"),
+		"Total system memory traffic of the domain from one level of cache, in bytes (Intel RDT MBMT perf event). Its rate is the memory bandwidth used by the domain.",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainMemoryBandwidthLocalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "memory_bandwidth_local_bytes_total"),
+		"Local memory traffic of the domain from one level of cache, in bytes (Intel RDT MBML perf event). Its rate is the local memory bandwidth used by the domain.",
+		[]string{"domain"},
+		nil)
+	m.libvirtLegacyDomainMemoryBandwidthTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "memory_bandwidth_total_bytes"),
+		"Deprecated, use libvirt_domain_memory_bandwidth_total_bytes_total. Same value, wrongly typed as a gauge.",
+		[]string{"domain"},
+		nil)
+	m.libvirtLegacyDomainMemoryBandwidthLocalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "memory_bandwidth_local_bytes"),
+		"Deprecated, use libvirt_domain_memory_bandwidth_local_bytes_total. Same value, wrongly typed as a gauge.",
+		[]string{"domain"},
+		nil)
+	m.libvirtLegacyDomainBlockRdTotalTimesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "legacy_read_time_total"),
+		"Deprecated, use libvirt_domain_block_stats_read_time_total. Former value of that metric, the number of bytes read divided by 10^9 instead of the read time.",
+		[]string{"domain", "source_file", "target_device"},
+		nil)
 
-	libvirtDomainBlockRdBytesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "read_bytes_total"),
+	m.libvirtDomainBlockRdBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "read_bytes_total"),
 		"Number of bytes read from a block device, in bytes.",
 		[]string{"domain", "source_file", "target_device"},
 		nil)
-	libvirtDomainBlockRdReqDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "read_requests_total"),
+	m.libvirtDomainBlockRdReqDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "read_requests_total"),
 		"Number of read requests from a block device.",
 		[]string{"domain", "source_file", "target_device"},
 		nil)
-	libvirtDomainBlockRdTotalTimesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "read_time_total"),
+	m.libvirtDomainBlockRdTotalTimesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "read_time_total"),
 		"Total time (ns) spent on reads from a block device, in ns, that is, 1/1,000,000,000 of a second, or 10−9 seconds.",
 		[]string{"domain", "source_file", "target_device"},
 		nil)
-	libvirtDomainBlockWrBytesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "write_bytes_total"),
+	m.libvirtDomainBlockWrBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "write_bytes_total"),
 		"Number of bytes written to a block device, in bytes.",
 		[]string{"domain", "source_file", "target_device"},
 		nil)
-	libvirtDomainBlockWrReqDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "write_requests_total"),
+	m.libvirtDomainBlockWrReqDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "write_requests_total"),
 		"Number of write requests to a block device.",
 		[]string{"domain", "source_file", "target_device"},
 		nil)
-	libvirtDomainBlockWrTotalTimesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "write_time_total"),
+	m.libvirtDomainBlockWrTotalTimesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "write_time_total"),
 		"Total time (ns) spent on writes on a block device, in ns, that is, 1/1,000,000,000 of a second, or 10−9 seconds.",
 		[]string{"domain", "source_file", "target_device"},
 		nil)
-	libvirtDomainBlockFlushReqDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "flush_requests_total"),
+	m.libvirtDomainBlockFlushReqDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "flush_requests_total"),
 		"Total flush requests from a block device.",
 		[]string{"domain", "source_file", "target_device"},
 		nil)
-	libvirtDomainBlockFlushTotalTimesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "flush_total"),
+	m.libvirtDomainBlockFlushTotalTimesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "flush_total"),
 		"Total time (ns) spent on cache flushing to a block device, in ns, that is, 1/1,000,000,000 of a second, or 10−9 seconds.",
 		[]string{"domain", "source_file", "target_device"},
 		nil)
-	libvirtDomainBlockAllocationDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "allocation"),
+	m.libvirtDomainBlockAllocationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "allocation"),
 		"Offset of the highest written sector on a block device.",
 		[]string{"domain", "source_file", "target_device"},
 		nil)
-	libvirtDomainBlockCapacityDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "capacity"),
+	m.libvirtDomainBlockBackingCapacityDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block", "backing_capacity_bytes"),
+		"Logical size in bytes of an image of the backing chain of the block device, by its index in the chain.",
+		[]string{"domain", "target_device", "backing_index"},
+		nil)
+	m.libvirtDomainBlockCapacityDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "capacity"),
 		"Logical size in bytes of the block device	backing image.",
 		[]string{"domain", "source_file", "target_device"},
 		nil)
-	libvirtDomainBlockPhysicalSizeDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_block_stats", "physicalsize"),
+	m.libvirtDomainBlockPhysicalSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "physicalsize"),
 		"Physical size in bytes of the container of the backing image.",
 		[]string{"domain", "source_file", "target_device"},
 		nil)
+	m.libvirtDomainBlockOvercommitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "overcommit_bytes"),
+		"Logical size minus physical size of a block device, in bytes. Zero or negative for fully allocated images.",
+		[]string{"domain", "source_file", "target_device"},
+		nil)
+	m.libvirtDomainBlockBackingChainDepthDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block", "backing_chain_depth"),
+		"Number of backing images below the image of a block device, 0 when it has no backing file.",
+		[]string{"domain", "target_device"},
+		nil)
+	m.libvirtDomainBlockDriverInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block", "driver_info"),
+		"Driver settings of a block device, empty when left to the hypervisor default.",
+		[]string{"domain", "target_device", "cache", "io", "discard"},
+		nil)
+	m.libvirtDomainBlockTotalRequestsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "total_iops_total"),
+		"Number of read and write requests to all the block devices of the domain.",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainBlockTotalBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "total_bytes_total"),
+		"Number of bytes read from and written to all the block devices of the domain.",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainBlockFlagsInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block", "flags_info"),
+		"Whether a block device is read-only and whether it is shareable between domains, e.g. for clusters.",
+		[]string{"domain", "target_device", "readonly", "shareable"},
+		nil)
+	m.libvirtDomainBlockInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block", "info"),
+		"Serial number of a block device, as presented to the guest.",
+		[]string{"domain", "target_device", "serial"},
+		nil)
+	m.libvirtDomainBlockLogicalBlockSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block", "logical_block_size_bytes"),
+		"Logical block size of a block device, as presented to the guest.",
+		[]string{"domain", "target_device"},
+		nil)
+	m.libvirtDomainBlockPhysicalBlockSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block", "physical_block_size_bytes"),
+		"Physical block size of a block device, as presented to the guest.",
+		[]string{"domain", "target_device"},
+		nil)
+	m.libvirtDomainBlockRdMergesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "read_merges_total"),
+		"Number of read requests merged by QEMU into other requests to a block device.",
+		[]string{"domain", "target_device"},
+		nil)
+	m.libvirtDomainBlockWrMergesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "write_merges_total"),
+		"Number of write requests merged by QEMU into other requests to a block device.",
+		[]string{"domain", "target_device"},
+		nil)
+	m.libvirtDomainBlockIdleTimeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "idle_time_seconds"),
+		"Time since the last I/O request to a block device, in seconds.",
+		[]string{"domain", "target_device"},
+		nil)
+	m.libvirtDomainBlockInvalidRdReqDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "invalid_read_requests_total"),
+		"Number of invalid read requests to a block device, e.g. out of its bounds.",
+		[]string{"domain", "target_device"},
+		nil)
+	m.libvirtDomainBlockInvalidWrReqDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "invalid_write_requests_total"),
+		"Number of invalid write requests to a block device, e.g. out of its bounds.",
+		[]string{"domain", "target_device"},
+		nil)
+	m.libvirtDomainBlockInvalidFlushReqDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "invalid_flush_requests_total"),
+		"Number of invalid flush requests to a block device.",
+		[]string{"domain", "target_device"},
+		nil)
+	m.libvirtDomainBlockRdLatencyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "read_latency_seconds"),
+		"Minimum, maximum or average latency of the read requests to a block device over the last interval, in seconds.",
+		[]string{"domain", "target_device", "interval", "stat"},
+		nil)
+	m.libvirtDomainBlockWrLatencyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "write_latency_seconds"),
+		"Minimum, maximum or average latency of the write requests to a block device over the last interval, in seconds.",
+		[]string{"domain", "target_device", "interval", "stat"},
+		nil)
+	m.libvirtDomainBlockFlushLatencyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_stats", "flush_latency_seconds"),
+		"Minimum, maximum or average latency of the flush requests to a block device over the last interval, in seconds.",
+		[]string{"domain", "target_device", "interval", "stat"},
+		nil)
+
+	m.libvirtDomainBlockJobCurDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_job", "cur"),
+		"Progress of the active block job of a block device, in units of libvirt_domain_block_job_end.",
+		[]string{"domain", "target_device"},
+		nil)
+	m.libvirtDomainBlockJobEndDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_job", "end"),
+		"Progress value at which the active block job of a block device is complete.",
+		[]string{"domain", "target_device"},
+		nil)
+	m.libvirtDomainBlockJobTypeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_block_job", "type"),
+		"Type of the active block job of a block device. 1: pull, 2: copy, 3: commit, 4: active commit, 5: backup",
+		[]string{"domain", "target_device"},
+		nil)
 
-	libvirtDomainInterfaceRxBytesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_interface_stats", "receive_bytes_total"),
+	m.libvirtDomainInterfaceRxBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface_stats", "receive_bytes_total"),
 		"Number of bytes received on a network interface, in bytes.",
 		[]string{"domain", "source_bridge", "target_device", "virtualportinterfaceid"},
 		nil)
-	libvirtDomainInterfaceRxPacketsDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_interface_stats", "receive_packets_total"),
+	m.libvirtDomainInterfaceRxPacketsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface_stats", "receive_packets_total"),
 		"Number of packets received on a network interface.",
 		[]string{"domain", "source_bridge", "target_device", "virtualportinterfaceid"},
 		nil)
-	libvirtDomainInterfaceRxErrsDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_interface_stats", "receive_errors_total"),
+	m.libvirtDomainInterfaceRxErrsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface_stats", "receive_errors_total"),
 		"Number of packet receive errors on a network interface.",
 		[]string{"domain", "source_bridge", "target_device", "virtualportinterfaceid"},
 		nil)
-	libvirtDomainInterfaceRxDropDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_interface_stats", "receive_drops_total"),
+	m.libvirtDomainInterfaceRxDropDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface_stats", "receive_drops_total"),
 		"Number of packet receive drops on a network interface.",
 		[]string{"domain", "source_bridge", "target_device", "virtualportinterfaceid"},
 		nil)
-	libvirtDomainInterfaceTxBytesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_interface_stats", "transmit_bytes_total"),
+	m.libvirtDomainInterfaceTxBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface_stats", "transmit_bytes_total"),
 		"Number of bytes transmitted on a network interface, in bytes.",
 		[]string{"domain", "source_bridge", "target_device", "virtualportinterfaceid"},
 		nil)
-	libvirtDomainInterfaceTxPacketsDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_interface_stats", "transmit_packets_total"),
+	m.libvirtDomainInterfaceTxPacketsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface_stats", "transmit_packets_total"),
 		"Number of packets transmitted on a network interface.",
 		[]string{"domain", "source_bridge", "target_device", "virtualportinterfaceid"},
 		nil)
-	libvirtDomainInterfaceTxErrsDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_interface_stats", "transmit_errors_total"),
+	m.libvirtDomainInterfaceTxErrsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface_stats", "transmit_errors_total"),
 		"Number of packet transmit errors on a network interface.",
 		[]string{"domain", "source_bridge", "target_device", "virtualportinterfaceid"},
 		nil)
-	libvirtDomainInterfaceTxDropDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_interface_stats", "transmit_drops_total"),
+	m.libvirtDomainInterfaceTxDropDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface_stats", "transmit_drops_total"),
 		"Number of packet transmit drops on a network interface.",
 		[]string{"domain", "source_bridge", "target_device", "virtualportinterfaceid"},
 		nil)
+	m.libvirtDomainInterfaceLinkUpDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface", "link_up"),
+		"Whether the link of a network interface is up, 0 when it was set down administratively.",
+		[]string{"domain", "target_device"},
+		nil)
+	m.libvirtDomainInterfaceVhostuserDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_interface", "vhostuser_info"),
+		"vhost-user network interface (e.g. an OVS-DPDK port), with the path of its socket and whether QEMU is the client or server end.",
+		[]string{"domain", "target_device", "vhostuser_path", "mode"},
+		nil)
 
-	libvirtDomainMemoryStatMajorfaultDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_memory_stats", "major_fault"),
+	m.libvirtDomainMemoryStatMajorfaultDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "major_fault"),
 		"Page faults occur when a process makes a valid access to virtual memory that is not available. "+
 			"When servicing the page fault, if disk IO is required, it is considered a major fault.",
 		[]string{"domain"},
 		nil)
-	libvirtDomainMemoryStatMinorFaultDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_memory_stats", "minor_fault"),
+	m.libvirtDomainMemoryStatMinorFaultDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "minor_fault"),
 		"Page faults occur when a process makes a valid access to virtual memory that is not available. "+
 			"When servicing the page not fault, if disk IO is required, it is considered a minor fault.",
 		[]string{"domain"},
 		nil)
-	libvirtDomainMemoryStatUnusedDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_memory_stats", "unused"),
+	m.libvirtDomainMemoryStatUnusedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "unused"),
 		"The amount of memory left completely unused by the system. Memory that is available but used for "+
 			"reclaimable caches should NOT be reported as free. This value is expressed in kB.",
 		[]string{"domain"},
 		nil)
-	libvirtDomainMemoryStatAvailableDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_memory_stats", "available"),
+	m.libvirtDomainMemoryStatAvailableDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "available"),
 		"The total amount of usable memory as seen by the domain. This value may be less than the amount of "+
 			"memory assigned to the domain if a balloon driver is in use or if the guest OS does not initialize all "+
 			"assigned pages. This value is expressed in kB.",
 		[]string{"domain"},
 		nil)
-	libvirtDomainMemoryStatActualBaloonDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_memory_stats", "actual_balloon"),
+	m.libvirtDomainMemoryStatActualBaloonDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "actual_balloon"),
 		"Current balloon value (in KB).",
 		[]string{"domain"},
 		nil)
-	libvirtDomainMemoryStatRssDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_memory_stats", "rss"),
+	m.libvirtDomainMemoryStatRssDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "rss"),
 		"Resident Set Size of the process running the domain. This value is in kB",
 		[]string{"domain"},
 		nil)
-	libvirtDomainMemoryStatUsableDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_memory_stats", "usable"),
+	m.libvirtDomainMemoryStatUsableDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "usable"),
 		"How much the balloon can be inflated without pushing the guest system to swap, corresponds "+
 			"to 'Available' in /proc/meminfo",
 		[]string{"domain"},
 		nil)
-	libvirtDomainMemoryStatDiskCachesDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_memory_stats", "disk_cache"),
+	m.libvirtDomainMemoryStatDiskCachesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "disk_cache"),
 		"The amount of memory, that can be quickly reclaimed without additional I/O (in kB)."+
 			"Typically these pages are used for caching files from disk.",
 		[]string{"domain"},
 		nil)
-	libvirtDomainMemoryStatUsedPercentDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_memory_stats", "used_percent"),
+	m.libvirtDomainMemoryStatSwapInDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "swap_in_total"),
+		"The total amount of data read from swap space (in kB).",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainMemoryStatSwapOutDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "swap_out_total"),
+		"The total amount of memory written out to swap space (in kB).",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainMemoryStatHugetlbPgAllocDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "hugetlb_pgalloc_total"),
+		"The number of successful huge page allocations initiated from within the domain.",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainMemoryStatHugetlbPgFailDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "hugetlb_pgfail_total"),
+		"The number of failed huge page allocations initiated from within the domain.",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainMemoryStatUsedPercentDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "used_percent"),
 		"The amount of memory in percent, that used by domain.",
 		[]string{"domain"},
 		nil)
+	m.libvirtDomainMemoryStatReportedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_memory_stats", "reported"),
+		"Whether the balloon driver of the guest reports memory statistics, when 0 the guest memory statistics are meaningless.",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainDirtyRateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "dirty_rate_mbps"),
+		"Rate at which the domain dirties its memory, in MiB/s, as of the last dirty rate calculation.",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainConfigHashDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "config_hash"),
+		"Hash of the persistent XML description of the domain, changing whenever the domain is reconfigured.",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainBalloonDeflateStuckDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "balloon_deflate_stuck"),
+		"Whether the balloon of the domain stayed above its target without shrinking over the last scrapes, e.g. because the guest can't give memory back.",
+		[]string{"domain"},
+		nil)
 
-	libvirtDomainInfoCPUStealTimeDesc = prometheus.NewDesc(
-		prometheus.BuildFQName("libvirt", "domain_info", "cpu_steal_time_total"),
+	m.libvirtDomainInfoCPUStealTimeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_info", "cpu_steal_time_total"),
 		"Amount of CPU time stolen from the domain, in ns, that is, 1/1,000,000,000 of a second, or 10−9 seconds.",
 		[]string{"domain", "cpu"},
 		nil)
-)
+	m.libvirtDomainVcpuNumaNodeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "vcpu_numa_node"),
+		"Guest NUMA node of a virtual CPU of the domain.",
+		[]string{"domain", "cpu", "node"},
+		nil)
+
+	m.libvirtDomainQemuProcessRssDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_qemu_process", "rss_bytes"),
+		"Resident set size of the QEMU process running the domain, in bytes.",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainQemuProcessThreadsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_qemu_process", "threads"),
+		"Number of threads of the QEMU process running the domain.",
+		[]string{"domain"},
+		nil)
+
+	m.libvirtDomainVcpuHaltPollSuccessDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_vcpu", "halt_poll_success_total"),
+		"Number of times KVM polled successfully for a wakeup of a halted virtual CPU of the domain, from the KVM debugfs.",
+		[]string{"domain", "cpu"},
+		nil)
+	m.libvirtDomainVcpuHaltWakeupDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain_vcpu", "halt_wakeup_total"),
+		"Number of times a halted virtual CPU of the domain was woken up, from the KVM debugfs.",
+		[]string{"domain", "cpu"},
+		nil)
+
+	m.libvirtDomainWatchdogEventsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "watchdog_events_total"),
+		"Number of times the watchdog device of the domain fired since the connection to libvirt was opened.",
+		[]string{"domain"},
+		nil)
+	m.libvirtDomainPanicEventsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "domain", "panic_events_total"),
+		"Number of times the domain crashed because of a guest panic since the connection to libvirt was opened.",
+		[]string{"domain"},
+		nil)
+
+	return m
+}
+
+// domainStatsTypes is the set of statistics groups requested for every domain by default.
+const domainStatsTypes = libvirt.DOMAIN_STATS_STATE | libvirt.DOMAIN_STATS_CPU_TOTAL |
+	libvirt.DOMAIN_STATS_INTERFACE | libvirt.DOMAIN_STATS_BALLOON | libvirt.DOMAIN_STATS_BLOCK |
+	libvirt.DOMAIN_STATS_PERF | libvirt.DOMAIN_STATS_VCPU
+
+// domainStatsGroups maps the names of the statistics groups, as virsh domstats names
+// them, to their libvirt constants.
+var domainStatsGroups = map[string]libvirt.DomainStatsTypes{
+	"state":     libvirt.DOMAIN_STATS_STATE,
+	"cpu-total": libvirt.DOMAIN_STATS_CPU_TOTAL,
+	"balloon":   libvirt.DOMAIN_STATS_BALLOON,
+	"vcpu":      libvirt.DOMAIN_STATS_VCPU,
+	"interface": libvirt.DOMAIN_STATS_INTERFACE,
+	"block":     libvirt.DOMAIN_STATS_BLOCK,
+	"perf":      libvirt.DOMAIN_STATS_PERF,
+	"iothread":  libvirt.DOMAIN_STATS_IOTHREAD,
+	"memory":    libvirt.DOMAIN_STATS_MEMORY,
+	"dirtyrate": libvirt.DOMAIN_STATS_DIRTYRATE,
+	"vm":        libvirt.DOMAIN_STATS_VM,
+}
+
+// ParseStatsGroups parses a comma-separated list of statistics group names. The state
+// group is always requested, as the state of the domains is needed to collect them.
+func ParseStatsGroups(groups string) (libvirt.DomainStatsTypes, error) {
+	types := libvirt.DOMAIN_STATS_STATE
+
+	for _, name := range strings.Split(groups, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		group, ok := domainStatsGroups[name]
+		if !ok {
+			return 0, fmt.Errorf("Unknown statistics group %q", name)
+		}
+		types |= group
+	}
+
+	return types, nil
+}
 
 // QueryCPUsResult holds the structured representative of QMP's "query-cpus" output.
 type QueryCPUsResult struct {
@@ -235,7 +1018,34 @@ type QueryCPUsResult struct {
 // QemuThread holds qemu thread info: which virtual cpu is it, what the thread PID is.
 type QemuThread struct {
 	CPU      int
-	ThreadID int `json:"thread_id"`
+	ThreadID int          `json:"thread_id"`
+	Props    QemuCPUProps `json:"props"`
+}
+
+// QemuCPUProps holds the topology properties of a virtual CPU.
+type QemuCPUProps struct {
+	// Only set when the guest has NUMA nodes
+	NodeID *int `json:"node-id"`
+}
+
+// QueryCPUsFastResult holds the structured representative of QMP's "query-cpus-fast" output.
+// Error is set by QEMU versions older than 2.12, which don't know the command.
+type QueryCPUsFastResult struct {
+	Return []QemuCPUFast   `json:"return"`
+	Error  *QMPErrorResult `json:"error"`
+}
+
+// QemuCPUFast holds a virtual CPU as returned by "query-cpus-fast".
+type QemuCPUFast struct {
+	CPUIndex int          `json:"cpu-index"`
+	ThreadID int          `json:"thread-id"`
+	Props    QemuCPUProps `json:"props"`
+}
+
+// QMPErrorResult holds the error returned by QEMU for a failed QMP command.
+type QMPErrorResult struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
 }
 
 // ReadStealTime reads the file /proc/<thread_id>/schedstat and returns
@@ -246,11 +1056,15 @@ func ReadStealTime(pid int) (float64, error) {
 	path := fmt.Sprintf("/proc/%d/schedstat", pid)
 
 	result, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/schedstat", pid))
+	if os.IsNotExist(err) {
+		// Either the thread is gone or the kernel is built without CONFIG_SCHED_INFO
+		return 0, fmt.Errorf("%s is not available: %w", path, err)
+	}
 	if err != nil {
 		return 0, err
 	}
 
-	values := strings.Split(string(result), " ")
+	values := strings.Split(strings.TrimSpace(string(result)), " ")
 	// We expect exactly 3 fields in the output, otherwise we return error
 	if len(values) != 3 {
 		return 0, fmt.Errorf("Unexpected amount of fields in %s. The file content is \"%s\"", path, result)
@@ -264,22 +1078,33 @@ func ReadStealTime(pid int) (float64, error) {
 	return retval, nil
 }
 
-// CollectDomainStealTime contacts the running QEMU instance via QemuMonitorCommand API call,
-// gets the PIDs of the running CPU threads.
-// It then calls ReadStealTime for every thread to obtain its steal times.
-func CollectDomainStealTime(ch chan<- prometheus.Metric, domain *libvirt.Domain) error {
-	var totalStealTime float64
-
-	// Get the domain name
-	domainName, err := domain.GetName()
+// QueryQemuThreads contacts the running QEMU instance via QemuMonitorCommand API call
+// and returns the PIDs of the running CPU threads.
+func QueryQemuThreads(domain DomainHandle) ([]QemuThread, error) {
+	// query QEMU directly to ask PID numbers of its CPU threads, "query-cpus-fast"
+	// doesn't interrupt the vCPUs and replaces "query-cpus" removed in QEMU 6.0
+	resultJSON, err := domain.QemuMonitorCommand("{\"execute\": \"query-cpus-fast\"}", libvirt.DOMAIN_QEMU_MONITOR_COMMAND_DEFAULT)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	var fastResult QueryCPUsFastResult
+	if err = json.Unmarshal([]byte(resultJSON), &fastResult); err != nil {
+		return nil, err
+	}
+
+	if fastResult.Error == nil {
+		threads := make([]QemuThread, 0, len(fastResult.Return))
+		for _, cpu := range fastResult.Return {
+			threads = append(threads, QemuThread{CPU: cpu.CPUIndex, ThreadID: cpu.ThreadID, Props: cpu.Props})
+		}
+
+		return threads, nil
 	}
 
-	// query QEMU directly to ask PID numbers of its CPU threads
-	resultJSON, err := domain.QemuMonitorCommand("{\"execute\": \"query-cpus\"}", libvirt.DOMAIN_QEMU_MONITOR_COMMAND_DEFAULT)
+	resultJSON, err = domain.QemuMonitorCommand("{\"execute\": \"query-cpus\"}", libvirt.DOMAIN_QEMU_MONITOR_COMMAND_DEFAULT)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Allocate a map for the json parser results
@@ -288,639 +1113,5619 @@ func CollectDomainStealTime(ch chan<- prometheus.Metric, domain *libvirt.Domain)
 	// Parse the result into the map
 	err = json.Unmarshal([]byte(resultJSON), &qemuThreadsResult)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Now iterate over qemuThreadsResult to get the list of QemuThread
-	for _, thread := range qemuThreadsResult.Return {
-		stealTime, err := ReadStealTime(thread.ThreadID)
-		if err != nil {
-			log.Printf("Error fetching steal time for the thread %d: %v. Skipping\n", thread.ThreadID, err)
+	return qemuThreadsResult.Return, nil
+}
 
-			continue
-		}
+// QemuThreadsCommand is a QMP command listing the CPU threads of QEMU, for the QEMU
+// builds which don't implement "query-cpus-fast" or "query-cpus", with the fields of
+// its result holding the CPU index and the thread PID.
+type QemuThreadsCommand struct {
+	Command     string
+	CPUField    string
+	ThreadField string
+}
 
-		// Increment the total steal time
-		totalStealTime += stealTime
+// qemuThreadsCommands are the QMP commands allowed to list the CPU threads: the upstream
+// ones, under their name or with the x- prefix QEMU uses for unstable commands.
+var qemuThreadsCommands = []string{"query-cpus-fast", "query-cpus", "x-query-cpus-fast", "x-query-cpus"}
+
+// NewQemuThreadsCommand validates a QMP command listing the CPU threads. Only the
+// commands of qemuThreadsCommands are allowed, so that the exporter never changes a domain.
+func NewQemuThreadsCommand(command, cpuField, threadField string) (*QemuThreadsCommand, error) {
+	allowed := false
+	for _, allowedCommand := range qemuThreadsCommands {
+		if command == allowedCommand {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil, fmt.Errorf("Invalid QMP command %q, only %s are allowed", command, strings.Join(qemuThreadsCommands, ", "))
+	}
+
+	if cpuField == "" || threadField == "" {
+		return nil, fmt.Errorf("The CPU and thread fields of the QMP command %s must be set", command)
+	}
+
+	return &QemuThreadsCommand{Command: command, CPUField: cpuField, ThreadField: threadField}, nil
+}
+
+// Query runs the command and returns the CPU threads it lists. The "props" field,
+// when present, is read as in "query-cpus-fast".
+func (c *QemuThreadsCommand) Query(domain DomainHandle) ([]QemuThread, error) {
+	command, err := json.Marshal(struct {
+		Execute string `json:"execute"`
+	}{c.Command})
+	if err != nil {
+		return nil, err
+	}
+
+	resultJSON, err := domain.QemuMonitorCommand(string(command), libvirt.DOMAIN_QEMU_MONITOR_COMMAND_DEFAULT)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Return []map[string]json.RawMessage `json:"return"`
+		Error  *QMPErrorResult              `json:"error"`
+	}
+	if err = json.Unmarshal([]byte(resultJSON), &result); err != nil {
+		return nil, err
+	}
+
+	if result.Error != nil {
+		return nil, fmt.Errorf("QMP command %s failed: %s: %s", c.Command, result.Error.Class, result.Error.Desc)
+	}
+
+	threads := make([]QemuThread, 0, len(result.Return))
+	for _, cpu := range result.Return {
+		var thread QemuThread
+		if err = json.Unmarshal(cpu[c.CPUField], &thread.CPU); err != nil {
+			return nil, fmt.Errorf("Invalid field %s in the result of the QMP command %s: %w", c.CPUField, c.Command, err)
+		}
+		if err = json.Unmarshal(cpu[c.ThreadField], &thread.ThreadID); err != nil {
+			return nil, fmt.Errorf("Invalid field %s in the result of the QMP command %s: %w", c.ThreadField, c.Command, err)
+		}
+		if props, ok := cpu["props"]; ok {
+			if err = json.Unmarshal(props, &thread.Props); err != nil {
+				return nil, err
+			}
+		}
+
+		threads = append(threads, thread)
+	}
+
+	return threads, nil
+}
+
+// CollectDomainStealTime calls ReadStealTime for every QEMU CPU thread to obtain its steal times.
+// The total is only reported if the steal time of every thread could be read, as a partial
+// sum would look like a counter reset. The error is the last one met, if any.
+func (e *LibvirtExporter) CollectDomainStealTime(ch chan<- prometheus.Metric, domainName string, threads []QemuThread, aggregateOnly bool) error {
+	var (
+		totalStealTime float64
+		lastErr        error
+	)
+
+	// Now iterate over the threads to get their steal time
+	for _, thread := range threads {
+		stealTime, err := ReadStealTime(thread.ThreadID)
+		if err != nil {
+			log.Printf("Error fetching steal time for the thread %d: %v. Skipping\n", thread.ThreadID, err)
+			lastErr = err
+
+			continue
+		}
+
+		// Increment the total steal time
+		totalStealTime += stealTime
+
+		if aggregateOnly {
+			continue
+		}
 
 		// Send the metric for this CPU
-		ch <- prometheus.MustNewConstMetric(libvirtDomainInfoCPUStealTimeDesc, prometheus.CounterValue, stealTime, domainName, strconv.Itoa(thread.CPU))
+		ch <- prometheus.MustNewConstMetric(e.libvirtDomainInfoCPUStealTimeDesc, prometheus.CounterValue, stealTime, domainName, strconv.Itoa(thread.CPU))
 	}
-	ch <- prometheus.MustNewConstMetric(libvirtDomainInfoCPUStealTimeDesc, prometheus.CounterValue, totalStealTime, domainName, "total")
+
+	if lastErr != nil {
+		return lastErr
+	}
+
+	ch <- prometheus.MustNewConstMetric(e.libvirtDomainInfoCPUStealTimeDesc, prometheus.CounterValue, totalStealTime, domainName, "total")
 
 	return nil
 }
 
-// CollectDomain extracts Prometheus metrics from a libvirt domain.
-func CollectDomain(ch chan<- prometheus.Metric, stat libvirt.DomainStats) error {
-	domainName, err := stat.Domain.GetName()
+// CollectDomainVcpuNodes reports the guest NUMA node of every virtual CPU of the domain.
+func (e *LibvirtExporter) CollectDomainVcpuNodes(ch chan<- prometheus.Metric, domainName string, threads []QemuThread) {
+	for _, thread := range threads {
+		if thread.Props.NodeID == nil {
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainVcpuNumaNodeDesc,
+			prometheus.GaugeValue,
+			1,
+			domainName,
+			strconv.Itoa(thread.CPU),
+			strconv.Itoa(*thread.Props.NodeID))
+	}
+}
+
+// ReadProcessStatus reads the file /proc/<pid>/status and returns its fields by name.
+func ReadProcessStatus(pid int) (map[string]string, error) {
+	result, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]string)
+
+	for _, line := range strings.Split(string(result), "\n") {
+		if name, value, found := strings.Cut(line, ":"); found {
+			fields[name] = strings.TrimSpace(value)
+		}
+	}
+
+	return fields, nil
+}
+
+// qemuProcessID returns the PID of the QEMU process the CPU threads belong to.
+func qemuProcessID(domainName string, threads []QemuThread) (int, error) {
+	if len(threads) == 0 {
+		return 0, fmt.Errorf("No QEMU CPU thread found for the domain %s", domainName)
+	}
+
+	threadStatus, err := ReadProcessStatus(threads[0].ThreadID)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(threadStatus["Tgid"])
+}
+
+// CollectQemuProcess reports the resource usage of the whole QEMU process running the domain,
+// which is the process the CPU threads belong to. Unlike the guest-reported memory statistics
+// it includes the overhead of the emulation.
+func (e *LibvirtExporter) CollectQemuProcess(ch chan<- prometheus.Metric, domainName string, threads []QemuThread) error {
+	pid, err := qemuProcessID(domainName, threads)
 	if err != nil {
 		return err
 	}
 
-	// Decode XML description of domain to get block device names, etc.
-	xmlDesc, err := stat.Domain.GetXMLDesc(0)
+	status, err := ReadProcessStatus(pid)
 	if err != nil {
 		return err
 	}
 
-	var desc libvirt_schema.Domain
-	if err = xml.Unmarshal([]byte(xmlDesc), &desc); err != nil {
+	// VmRSS is expressed in kB, e.g. "VmRSS:	  123456 kB"
+	rss, err := strconv.ParseFloat(strings.TrimSuffix(status["VmRSS"], " kB"), 64)
+	if err != nil {
 		return err
 	}
 
-	// Report domain info.
-	info, err := stat.Domain.GetInfo()
+	threadCount, err := strconv.ParseFloat(status["Threads"], 64)
 	if err != nil {
 		return err
 	}
+
 	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainInfoMaxMemDesc,
-		prometheus.GaugeValue,
-		float64(info.MaxMem)*1024,
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainInfoMemoryUsageDesc,
+		e.libvirtDomainQemuProcessRssDesc,
 		prometheus.GaugeValue,
-		float64(info.Memory)*1024,
+		rss*1024,
 		domainName)
 	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainInfoNrVirtCPUDesc,
+		e.libvirtDomainQemuProcessThreadsDesc,
 		prometheus.GaugeValue,
-		float64(info.NrVirtCpu),
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainInfoCPUTimeDesc,
-		prometheus.CounterValue,
-		float64(info.CpuTime)/1e9,
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainInfoVirDomainState,
-		prometheus.CounterValue,
-		float64(info.State),
+		threadCount,
 		domainName)
 
-	var DiskSource string
+	return nil
+}
 
-	// Report block device statistics.
-	for _, disk := range stat.Block {
-		if disk.Name == "hdc" {
-			continue
-		}
+// sysfsPath is where the sysfs of the host is mounted.
+const sysfsPath = "/sys"
 
-		/*  "block.<num>.path" - string describing the source of block device <num>,
-		    if it is a file or block device (omitted for network
-		    sources and drives with no media inserted). For network device (i.e. rbd) take from xml. */
-		for _, dev := range desc.Devices.Disks {
-			if dev.Target.Device == disk.Name {
-				if disk.PathSet {
-					DiskSource = disk.Path
-				} else {
-					DiskSource = dev.Source.Name
-				}
+// CollectNodeCPUFrequencies reports the current frequency of every CPU of the host, read from
+// the cpu<id>/cpufreq directories of the sysfs mounted at sysfsRoot. Nothing is reported when
+// frequency scaling isn't available, as in most virtual machines.
+func (e *LibvirtExporter) CollectNodeCPUFrequencies(ch chan<- prometheus.Metric, sysfsRoot string) error {
+	paths, err := filepath.Glob(filepath.Join(sysfsRoot, "devices", "system", "cpu", "cpu[0-9]*", "cpufreq", "scaling_cur_freq"))
+	if err != nil {
+		return err
+	}
 
-				break
+	for _, path := range paths {
+		// The frequency is in kHz
+		result, err := ioutil.ReadFile(path)
+		if err != nil {
+			// The CPU went offline since the glob
+			if os.IsNotExist(err) {
+				continue
 			}
+			return err
 		}
 
-		// https://libvirt.org/html/libvirt-libvirt-domain.html#virConnectGetAllDomainStats
-		if disk.RdBytesSet {
-			ch <- prometheus.MustNewConstMetric(
-				libvirtDomainBlockRdBytesDesc,
-				prometheus.CounterValue,
-				float64(disk.RdBytes),
-				domainName,
-				DiskSource,
-				disk.Name)
+		frequency, err := strconv.ParseFloat(strings.TrimSpace(string(result)), 64)
+		if err != nil {
+			return err
 		}
 
-		if disk.RdReqsSet {
-			ch <- prometheus.MustNewConstMetric(
-				libvirtDomainBlockRdReqDesc,
-				prometheus.CounterValue,
-				float64(disk.RdReqs),
-				domainName,
-				DiskSource,
-				disk.Name)
-		}
+		cpu := strings.TrimPrefix(filepath.Base(filepath.Dir(filepath.Dir(path))), "cpu")
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtNodeCPUFrequencyDesc,
+			prometheus.GaugeValue,
+			frequency*1000,
+			cpu)
+	}
 
-		if disk.RdBytesSet {
-			ch <- prometheus.MustNewConstMetric(
-				libvirtDomainBlockRdTotalTimesDesc,
-				prometheus.CounterValue,
-				float64(disk.RdBytes)/1e9,
-				domainName,
-				DiskSource,
-				disk.Name)
-		}
+	return nil
+}
 
-		if disk.WrBytesSet {
-			ch <- prometheus.MustNewConstMetric(
-				libvirtDomainBlockWrBytesDesc,
-				prometheus.CounterValue,
-				float64(disk.WrBytes),
-				domainName,
-				DiskSource,
-				disk.Name)
-		}
+// kvmDebugfsPath is where KVM exposes the statistics of its virtual machines,
+// in a <pid>-<fd> directory per virtual machine with a vcpu<id> directory per virtual CPU.
+const kvmDebugfsPath = "/sys/kernel/debug/kvm"
 
-		if disk.WrReqsSet {
-			ch <- prometheus.MustNewConstMetric(
-				libvirtDomainBlockWrReqDesc,
-				prometheus.CounterValue,
-				float64(disk.WrReqs),
-				domainName,
-				DiskSource,
-				disk.Name)
-		}
+// readKVMCounter reads a counter of the KVM debugfs.
+func readKVMCounter(path string) (float64, error) {
+	result, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
 
-		if disk.WrTimesSet {
-			ch <- prometheus.MustNewConstMetric(
-				libvirtDomainBlockWrTotalTimesDesc,
-				prometheus.CounterValue,
-				float64(disk.WrTimes)/1e9,
-				domainName,
-				DiskSource,
-				disk.Name)
-		}
+	return strconv.ParseFloat(strings.TrimSpace(string(result)), 64)
+}
 
-		if disk.FlReqsSet {
-			ch <- prometheus.MustNewConstMetric(
-				libvirtDomainBlockFlushReqDesc,
-				prometheus.CounterValue,
-				float64(disk.FlReqs),
-				domainName,
-				DiskSource,
-				disk.Name)
+// CollectDomainHaltPolling reports the halt-polling statistics of every QEMU CPU thread,
+// read from the KVM debugfs. The vcpu<id> directories are matched with the threads by
+// their pid file, as the KVM vCPU id isn't always the QEMU CPU index (e.g. the APIC id on x86).
+func (e *LibvirtExporter) CollectDomainHaltPolling(ch chan<- prometheus.Metric, domainName string, threads []QemuThread) error {
+	// debugfs is only readable by root, and not necessarily mounted
+	if _, err := os.Stat(kvmDebugfsPath); err != nil {
+		if os.IsPermission(err) {
+			return fmt.Errorf("%s is not readable, the exporter has to run as root: %w", kvmDebugfsPath, err)
 		}
 
-		if disk.FlTimesSet {
-			ch <- prometheus.MustNewConstMetric(
-				libvirtDomainBlockFlushTotalTimesDesc,
-				prometheus.CounterValue,
-				float64(disk.FlTimes),
-				domainName,
-				DiskSource,
-				disk.Name)
+		return fmt.Errorf("%s is not available, is debugfs mounted? %w", kvmDebugfsPath, err)
+	}
+
+	pid, err := qemuProcessID(domainName, threads)
+	if err != nil {
+		return err
+	}
+
+	pidFiles, err := filepath.Glob(filepath.Join(kvmDebugfsPath, fmt.Sprintf("%d-*", pid), "vcpu*", "pid"))
+	if err != nil {
+		return err
+	}
+
+	vcpuDirs := make(map[int]string, len(pidFiles))
+	for _, pidFile := range pidFiles {
+		threadID, err := readKVMCounter(pidFile)
+		if err != nil {
+			return err
 		}
+		vcpuDirs[int(threadID)] = filepath.Dir(pidFile)
+	}
 
-		if disk.AllocationSet {
-			ch <- prometheus.MustNewConstMetric(
-				libvirtDomainBlockAllocationDesc,
-				prometheus.CounterValue,
-				float64(disk.Allocation),
-				domainName,
-				DiskSource,
-				disk.Name)
+	for _, thread := range threads {
+		dir, ok := vcpuDirs[thread.ThreadID]
+		if !ok {
+			return fmt.Errorf("No KVM debugfs directory found for the thread %d of the domain %s", thread.ThreadID, domainName)
 		}
 
-		if disk.CapacitySet {
-			ch <- prometheus.MustNewConstMetric(
-				libvirtDomainBlockCapacityDesc,
-				prometheus.CounterValue,
-				float64(disk.Capacity),
-				domainName,
-				DiskSource,
-				disk.Name)
+		pollSuccess, err := readKVMCounter(filepath.Join(dir, "halt_successful_poll"))
+		if err != nil {
+			return err
 		}
 
-		if disk.PhysicalSet {
-			ch <- prometheus.MustNewConstMetric(
-				libvirtDomainBlockPhysicalSizeDesc,
-				prometheus.CounterValue,
-				float64(disk.Physical),
-				domainName,
-				DiskSource,
-				disk.Name)
+		wakeup, err := readKVMCounter(filepath.Join(dir, "halt_wakeup"))
+		if err != nil {
+			return err
 		}
+
+		cpu := strconv.Itoa(thread.CPU)
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainVcpuHaltPollSuccessDesc,
+			prometheus.CounterValue,
+			pollSuccess,
+			domainName,
+			cpu)
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainVcpuHaltWakeupDesc,
+			prometheus.CounterValue,
+			wakeup,
+			domainName,
+			cpu)
 	}
 
-	// Report network interface statistics.
-	for _, iface := range stat.Net {
-		var (
-			SourceBridge           string
-			VirtualPortInterfaceID string
-		)
+	return nil
+}
 
-		// Additional info for ovs network
-		for _, net := range desc.Devices.Interfaces {
-			if net.Target.Device == iface.Name {
-				SourceBridge = net.Source.Bridge
-				VirtualPortInterfaceID = net.Virtualport.Parameters.InterfaceID
+// QueryBlockStatsResult holds the structured representative of QMP's "query-blockstats" output.
+type QueryBlockStatsResult struct {
+	Return []QemuBlockStats `json:"return"`
+}
 
-				break
-			}
-		}
+// QemuBlockStats holds the statistics QEMU keeps about a block device.
+type QemuBlockStats struct {
+	Device string             `json:"device"`
+	Qdev   string             `json:"qdev"`
+	Stats  QemuBlockIOCounter `json:"stats"`
+}
 
-		if iface.RxBytesSet {
-			ch <- prometheus.MustNewConstMetric(
-				libvirtDomainInterfaceRxBytesDesc,
-				prometheus.CounterValue,
-				float64(iface.RxBytes),
-				domainName,
-				SourceBridge,
-				iface.Name,
-				VirtualPortInterfaceID)
-		}
+// QemuBlockIOCounter holds the I/O counters of a block device which libvirt doesn't report.
+type QemuBlockIOCounter struct {
+	RdMerged        uint64  `json:"rd_merged"`
+	WrMerged        uint64  `json:"wr_merged"`
+	IdleTimeNs      *uint64 `json:"idle_time_ns"`
+	InvalidRdOps    uint64  `json:"invalid_rd_operations"`
+	InvalidWrOps    uint64  `json:"invalid_wr_operations"`
+	InvalidFlushOps uint64  `json:"invalid_flush_operations"`
 
-		if iface.RxPktsSet {
-			ch <- prometheus.MustNewConstMetric(
-				libvirtDomainInterfaceRxPacketsDesc,
-				prometheus.CounterValue,
-				float64(iface.RxPkts),
-				domainName,
-				SourceBridge,
-				iface.Name,
-				VirtualPortInterfaceID)
-		}
+	// Only present when latency accounting intervals are configured for the device
+	TimedStats []QemuBlockTimedStats `json:"timed_stats"`
+}
 
-		if iface.RxErrsSet {
-			ch <- prometheus.MustNewConstMetric(
-				libvirtDomainInterfaceRxErrsDesc,
-				prometheus.CounterValue,
-				float64(iface.RxErrs),
-				domainName,
-				SourceBridge,
-				iface.Name,
-				VirtualPortInterfaceID)
+// QemuBlockTimedStats holds the latencies of the requests to a block device, in ns,
+// over the last interval of the given length, in seconds.
+type QemuBlockTimedStats struct {
+	IntervalLength    int    `json:"interval_length"`
+	MinRdLatencyNs    uint64 `json:"min_rd_latency_ns"`
+	MaxRdLatencyNs    uint64 `json:"max_rd_latency_ns"`
+	AvgRdLatencyNs    uint64 `json:"avg_rd_latency_ns"`
+	MinWrLatencyNs    uint64 `json:"min_wr_latency_ns"`
+	MaxWrLatencyNs    uint64 `json:"max_wr_latency_ns"`
+	AvgWrLatencyNs    uint64 `json:"avg_wr_latency_ns"`
+	MinFlushLatencyNs uint64 `json:"min_flush_latency_ns"`
+	MaxFlushLatencyNs uint64 `json:"max_flush_latency_ns"`
+	AvgFlushLatencyNs uint64 `json:"avg_flush_latency_ns"`
+}
+
+// Alias returns the alias of the disk in the domain XML the statistics belong to.
+// Older QEMU versions name the device after the drive ("drive-<alias>"), newer ones
+// using -blockdev leave it empty and only give the path of the guest device.
+func (s QemuBlockStats) Alias() string {
+	if s.Device != "" {
+		return strings.TrimPrefix(s.Device, "drive-")
+	}
+
+	alias := strings.TrimPrefix(s.Qdev, "/machine/peripheral/")
+	if i := strings.Index(alias, "/"); i >= 0 {
+		alias = alias[:i]
+	}
+
+	return alias
+}
+
+// QueryQemuBlockStats asks QEMU for the statistics of the block devices of the domain.
+func QueryQemuBlockStats(domain DomainHandle) ([]QemuBlockStats, error) {
+	resultJSON, err := domain.QemuMonitorCommand("{\"execute\": \"query-blockstats\"}", libvirt.DOMAIN_QEMU_MONITOR_COMMAND_DEFAULT)
+	if err != nil {
+		return nil, err
+	}
+
+	var result QueryBlockStatsResult
+	if err = json.Unmarshal([]byte(resultJSON), &result); err != nil {
+		return nil, err
+	}
+
+	return result.Return, nil
+}
+
+// QMPCustomCommand is a QMP query command of --collector.qmp-custom, whose result
+// fields are exported as gauges.
+type QMPCustomCommand struct {
+	Command string            `json:"command"`
+	Metrics []QMPCustomMetric `json:"metrics"`
+}
+
+// QMPCustomMetric is a gauge of --collector.qmp-custom, taken from a numeric or
+// boolean field of the result of its command.
+type QMPCustomMetric struct {
+	Name string `json:"name"`
+	Help string `json:"help"`
+	// Dot-separated object keys and array indices, e.g. "ram.transferred"
+	Path string `json:"path"`
+
+	desc *prometheus.Desc
+}
+
+// LoadQMPCustomCommands reads and validates the --collector.qmp-custom file, a JSON
+// list of commands, and builds the descriptors of their metrics under the namespace.
+// Only the query-* commands are allowed, so that the exporter never changes a domain.
+func LoadQMPCustomCommands(path string, namespace string) ([]QMPCustomCommand, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var commands []QMPCustomCommand
+	if err = json.Unmarshal(content, &commands); err != nil {
+		return nil, fmt.Errorf("Malformed QMP custom commands file %s: %w", path, err)
+	}
+
+	names := make(map[string]bool)
+	for i := range commands {
+		command := &commands[i]
+		if !strings.HasPrefix(command.Command, "query-") {
+			return nil, fmt.Errorf("Invalid QMP command %q, only query-* commands are allowed", command.Command)
 		}
 
-		if iface.RxDropSet {
-			ch <- prometheus.MustNewConstMetric(
-				libvirtDomainInterfaceRxDropDesc,
-				prometheus.CounterValue,
-				float64(iface.RxDrop),
-				domainName,
-				SourceBridge,
-				iface.Name,
-				VirtualPortInterfaceID)
+		for j := range command.Metrics {
+			metric := &command.Metrics[j]
+			if !labelNameRegexp.MatchString(metric.Name) || names[metric.Name] {
+				return nil, fmt.Errorf("Invalid or duplicate metric name %q for the QMP command %s", metric.Name, command.Command)
+			}
+			names[metric.Name] = true
+
+			if metric.Path == "" {
+				return nil, fmt.Errorf("Missing path of the metric %s for the QMP command %s", metric.Name, command.Command)
+			}
+
+			help := metric.Help
+			if help == "" {
+				help = fmt.Sprintf("Field %s of the result of the QMP command %s.", metric.Path, command.Command)
+			}
+
+			metric.desc = prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, "domain_qmp", metric.Name),
+				help,
+				[]string{"domain"},
+				nil)
 		}
+	}
 
-		if iface.TxBytesSet {
-			ch <- prometheus.MustNewConstMetric(
-				libvirtDomainInterfaceTxBytesDesc,
-				prometheus.CounterValue,
-				float64(iface.TxBytes),
-				domainName,
-				SourceBridge,
-				iface.Name,
-				VirtualPortInterfaceID)
+	return commands, nil
+}
+
+// QMPCustomResult holds the result of a command of --collector.qmp-custom, of any structure.
+type QMPCustomResult struct {
+	Return interface{}     `json:"return"`
+	Error  *QMPErrorResult `json:"error"`
+}
+
+// QueryQMPCustom runs a command of --collector.qmp-custom and returns its result.
+// The error is a libvirt.Error when the command couldn't be sent to QEMU.
+func QueryQMPCustom(domain DomainHandle, command string) (interface{}, error) {
+	request, err := json.Marshal(map[string]string{"execute": command})
+	if err != nil {
+		return nil, err
+	}
+
+	resultJSON, err := domain.QemuMonitorCommand(string(request), libvirt.DOMAIN_QEMU_MONITOR_COMMAND_DEFAULT)
+	if err != nil {
+		return nil, err
+	}
+
+	var result QMPCustomResult
+	if err = json.Unmarshal([]byte(resultJSON), &result); err != nil {
+		return nil, err
+	}
+
+	if result.Error != nil {
+		return nil, fmt.Errorf("QMP command %s failed: %s: %s", command, result.Error.Class, result.Error.Desc)
+	}
+
+	return result.Return, nil
+}
+
+// resolveQMPPath returns the numeric value of the field of a QMP result at the given
+// dot-separated path. Booleans are 0 or 1. The second return value is false when the
+// field is missing or isn't a number or a boolean.
+func resolveQMPPath(result interface{}, path string) (float64, bool) {
+	current := result
+
+	for _, step := range strings.Split(path, ".") {
+		switch value := current.(type) {
+		case map[string]interface{}:
+			current = value[step]
+		case []interface{}:
+			index, err := strconv.Atoi(step)
+			if err != nil || index < 0 || index >= len(value) {
+				return 0, false
+			}
+			current = value[index]
+		default:
+			return 0, false
 		}
+	}
 
-		if iface.TxPktsSet {
+	switch value := current.(type) {
+	case float64:
+		return value, true
+	case bool:
+		if value {
+			return 1, true
+		}
+
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+// DomainHandle is the part of *libvirt.Domain used to collect the metrics of a domain,
+// so that they can also be collected from canned data.
+type DomainHandle interface {
+	GetName() (string, error)
+	GetUUIDString() (string, error)
+	Free() error
+	GetXMLDesc(flags libvirt.DomainXMLFlags) (string, error)
+	GetMetadata(metadataType libvirt.DomainMetadataType, uri string, flags libvirt.DomainModificationImpact) (string, error)
+	GetInfo() (*libvirt.DomainInfo, error)
+	GetLaunchSecurityInfo(flags uint32) (*libvirt.DomainLaunchSecurityParameters, error)
+	GetBlockJobInfo(disk string, flags libvirt.DomainBlockJobInfoFlags) (*libvirt.DomainBlockJobInfo, error)
+	GetBlkioParameters(flags libvirt.DomainModificationImpact) (*libvirt.DomainBlkioParameters, error)
+	GetMemoryParameters(flags libvirt.DomainModificationImpact) (*libvirt.DomainMemoryParameters, error)
+	GetJobStats(flags libvirt.DomainGetJobStatsFlags) (*libvirt.DomainJobInfo, error)
+	MemoryStats(nrStats uint32, flags uint32) ([]libvirt.DomainMemoryStat, error)
+	QemuMonitorCommand(command string, flags libvirt.DomainQemuMonitorCommandFlags) (string, error)
+}
+
+// CollectDomain extracts Prometheus metrics from a libvirt domain, given its statistics.
+func (e *LibvirtExporter) CollectDomain(ch chan<- prometheus.Metric, domain DomainHandle, stat libvirt.DomainStats) error {
+	domainName, err := domain.GetName()
+	if err != nil {
+		return err
+	}
+
+	// Decode XML description of domain to get block device names, etc. Large
+	// descriptions are costly to parse, so it's skipped when nothing needs it.
+	var desc libvirt_schema.Domain
+	if e.needsDomainXML() {
+		var xmlDesc string
+		err = e.callLibvirt(func() (err error) {
+			xmlDesc, err = domain.GetXMLDesc(0)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		if err = xml.Unmarshal([]byte(xmlDesc), &desc); err != nil {
+			return err
+		}
+	}
+
+	// The labels of the block devices and interfaces taken from the XML description
+	// are XML-derived as well, without it they only have what libvirt reports.
+	devicesDesc := &libvirt_schema.Domain{}
+	if e.config.Collectors.DomainXML {
+		devicesDesc = &desc
+	}
+
+	// The other metrics come from the statistics already fetched or from other
+	// calls, a failure of GetInfo doesn't prevent them from being reported
+	if e.config.Collectors.Info {
+		if err = e.collectDomainInfo(ch, domain, stat, domainName); err != nil {
+			log.Printf("Error fetching the information of the domain %s: %v\n", domainName, err)
+			e.countCollectorError("info")
+		}
+	}
+
+	if len(e.config.MetadataLabels) > 0 {
+		labelValues := []string{domainName}
+		for _, label := range e.config.MetadataLabels {
+			labelValues = append(labelValues, label.Resolve(desc.Metadata.Elements))
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainMetadataDesc,
+			prometheus.GaugeValue,
+			1,
+			labelValues...)
+	}
+
+	if e.config.Collectors.DomainXML {
+		e.collectDomainXML(ch, domain, stat, &desc, domainName)
+	}
+
+	// Report cache and memory bandwidth monitoring (Intel RDT), only available when
+	// the corresponding perf events are enabled for the domain.
+	if stat.Perf != nil {
+		if stat.Perf.CmtSet {
 			ch <- prometheus.MustNewConstMetric(
-				libvirtDomainInterfaceTxPacketsDesc,
-				prometheus.CounterValue,
-				float64(iface.TxPkts),
-				domainName,
-				SourceBridge,
-				iface.Name,
-				VirtualPortInterfaceID)
+				e.libvirtDomainCacheOccupancyDesc,
+				prometheus.GaugeValue,
+				float64(stat.Perf.Cmt),
+				domainName)
 		}
 
-		if iface.TxErrsSet {
+		if stat.Perf.MbmtSet {
 			ch <- prometheus.MustNewConstMetric(
-				libvirtDomainInterfaceTxErrsDesc,
+				e.libvirtDomainMemoryBandwidthTotalDesc,
 				prometheus.CounterValue,
-				float64(iface.TxErrs),
-				domainName,
-				SourceBridge,
-				iface.Name,
-				VirtualPortInterfaceID)
+				float64(stat.Perf.Mbmt),
+				domainName)
+
+			if e.config.LegacyMetrics {
+				ch <- prometheus.MustNewConstMetric(
+					e.libvirtLegacyDomainMemoryBandwidthTotalDesc,
+					prometheus.GaugeValue,
+					float64(stat.Perf.Mbmt),
+					domainName)
+			}
 		}
 
-		if iface.TxDropSet {
+		if stat.Perf.MbmlSet {
 			ch <- prometheus.MustNewConstMetric(
-				libvirtDomainInterfaceTxDropDesc,
+				e.libvirtDomainMemoryBandwidthLocalDesc,
 				prometheus.CounterValue,
-				float64(iface.TxDrop),
-				domainName,
-				SourceBridge,
-				iface.Name,
-				VirtualPortInterfaceID)
+				float64(stat.Perf.Mbml),
+				domainName)
+
+			if e.config.LegacyMetrics {
+				ch <- prometheus.MustNewConstMetric(
+					e.libvirtLegacyDomainMemoryBandwidthLocalDesc,
+					prometheus.GaugeValue,
+					float64(stat.Perf.Mbml),
+					domainName)
+			}
 		}
 	}
 
-	// Collect Memory Stats
-	var (
-		MemoryStats libvirt_schema.VirDomainMemoryStats
-		usedPercent float64
-	)
+	// Only requested with the dirtyrate statistics group, and only set once the dirty
+	// rate of the domain was calculated. Checked against the group as well, as it is
+	// only described with it.
+	if e.statsGroups()&libvirt.DOMAIN_STATS_DIRTYRATE != 0 && stat.DirtyRate != nil && stat.DirtyRate.MegabytesPerSecondSet {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainDirtyRateDesc,
+			prometheus.GaugeValue,
+			float64(stat.DirtyRate.MegabytesPerSecond),
+			domainName)
+	}
 
-	memorystat, err := stat.Domain.MemoryStats(11, 0)
-	if err == nil {
-		MemoryStats = MemoryStatCollect(&memorystat)
-		if MemoryStats.Usable != 0 && MemoryStats.Available != 0 {
-			usedPercent = (float64(MemoryStats.Available) - float64(MemoryStats.Usable)) / (float64(MemoryStats.Available) / float64(100))
+	if e.config.Collectors.Block {
+		e.collectDomainBlockStats(ch, stat, devicesDesc, domainName)
+	}
+
+	// The QEMU monitor may be restricted to some domains, the others still get the
+	// metrics which don't rely on it
+	qemuMonitor := stat.State != nil && stat.State.State == libvirt.DOMAIN_RUNNING && e.qemuMonitorAllowed(domainName) && e.qemuMonitorUsable()
+
+	if e.config.Collectors.QMPBlockStats && qemuMonitor {
+		if err = e.collectDomainQemuBlockStats(ch, domain, &desc, domainName); err != nil {
+			e.handleQemuMonitorError(err)
+		}
+	}
+
+	if len(e.config.QMPCustomCommands) > 0 && qemuMonitor {
+		if err = e.collectDomainQMPCustom(ch, domain, domainName); err != nil {
+			e.handleQemuMonitorError(err)
+		}
+	}
+
+	if e.config.Collectors.BlockJobs && stat.State != nil && stat.State.State != libvirt.DOMAIN_SHUTOFF {
+		e.collectDomainBlockJobs(ch, domain, stat, domainName)
+	}
+
+	if e.config.Collectors.ConfigHash {
+		if err = e.collectDomainConfigHash(ch, domain, domainName); err != nil {
+			log.Printf("Error fetching the persistent configuration of the domain %s: %v\n", domainName, err)
+			e.countCollectorError("config_hash")
+		}
+	}
+
+	// Only the domains with a <blkiotune> element, the weights of the others being the
+	// defaults of the host
+	if e.config.Collectors.Blkio && desc.Blkiotune != nil {
+		if err = e.collectDomainBlkio(ch, domain, domainName); err != nil {
+			log.Printf("Error fetching the block I/O tuning of the domain %s: %v\n", domainName, err)
+			e.countCollectorError("blkio")
+		}
+	}
+
+	// Likewise, only the domains with a <memtune> element
+	if e.config.Collectors.Memtune && desc.Memtune != nil {
+		if err = e.collectDomainMemtune(ch, domain, domainName); err != nil {
+			log.Printf("Error fetching the memory tuning of the domain %s: %v\n", domainName, err)
+			e.countCollectorError("memtune")
 		}
 	}
 
+	if e.config.Collectors.Interface {
+		e.collectDomainInterfaceStats(ch, stat, devicesDesc, domainName)
+	}
+
+	if e.config.Collectors.Memory {
+		e.collectDomainMemoryStats(ch, domain, stat, devicesDesc, domainName)
+	}
+
+	return nil
+}
+
+// maxDescriptionLength is the number of characters of the description of a domain
+// kept in its label, as descriptions are free-form and can be arbitrarily long.
+const maxDescriptionLength = 256
+
+// truncateLabel returns the first length characters of a label value.
+func truncateLabel(value string, length int) string {
+	runes := []rune(value)
+	if len(runes) <= length {
+		return value
+	}
+
+	return string(runes[:length])
+}
+
+// needsDomainXML returns whether the XML description of the domains has to be parsed:
+// for the XML-derived metrics and labels, the metadata labels, to match the QEMU
+// block devices with the disks, or to find the domains with block I/O or memory tuning.
+func (e *LibvirtExporter) needsDomainXML() bool {
+	return e.config.Collectors.DomainXML || len(e.config.MetadataLabels) > 0 || e.config.Collectors.QMPBlockStats ||
+		e.config.Collectors.Blkio || e.config.Collectors.Memtune
+}
+
+// collectDomainXML reports the metrics derived from the XML description of the domain:
+// its CPU model, firmware, devices and memory backing.
+func (e *LibvirtExporter) collectDomainXML(ch chan<- prometheus.Metric, domain DomainHandle, stat libvirt.DomainStats, desc *libvirt_schema.Domain, domainName string) {
+	if desc.CPU != nil {
+		e.collectDomainCPUModel(ch, desc.CPU, domainName)
+	}
+
+	e.collectDomainGraphics(ch, desc.Devices.Graphics, domainName)
+
+	for _, tpm := range desc.Devices.TPMs {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainTPMInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			domainName,
+			tpm.Model,
+			tpm.Backend.Type,
+			tpm.Backend.Version)
+	}
+
+	var secureBoot float64
+	if secureBootEnabled(desc.OS) {
+		secureBoot = 1
+	}
 	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatMajorfaultDesc,
-		prometheus.CounterValue,
-		float64(MemoryStats.MajorFault),
+		e.libvirtDomainSecureBootEnabledDesc,
+		prometheus.GaugeValue,
+		secureBoot,
 		domainName)
+
+	e.collectDomainLaunchSecurity(ch, domain, stat, desc, domainName)
+
+	for _, hostdev := range desc.Devices.Hostdevs {
+		address, ok := hostdevAddress(hostdev)
+		if !ok {
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainHostdevInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			domainName,
+			hostdev.Type,
+			address)
+	}
+
 	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatMinorFaultDesc,
-		prometheus.CounterValue,
-		float64(MemoryStats.MinorFault),
+		e.libvirtDomainDescriptionInfoDesc,
+		prometheus.GaugeValue,
+		1,
+		domainName,
+		desc.Title,
+		truncateLabel(desc.Description, maxDescriptionLength))
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainEmulatorInfoDesc,
+		prometheus.GaugeValue,
+		1,
+		domainName,
+		strings.TrimSpace(desc.Devices.Emulator),
+		desc.Type)
+
+	if connected, ok := guestAgentConnected(desc.Devices.Channels); ok {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainAgentConnectedDesc,
+			prometheus.GaugeValue,
+			connected,
+			domainName)
+	}
+
+	for _, rng := range desc.Devices.RNGs {
+		source := strings.TrimSpace(rng.Backend.Path)
+		if rng.Backend.Model == "egd" {
+			source = rng.Backend.Type
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainRNGInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			domainName,
+			rng.Model,
+			rng.Backend.Model,
+			source)
+	}
+
+	e.collectDomainVideos(ch, desc.Devices.Videos, domainName)
+
+	e.collectDomainBootOrder(ch, desc, domainName)
+
+	if desc.MemoryBacking != nil && desc.MemoryBacking.Hugepages != nil {
+		e.collectDomainHugepages(ch, desc.MemoryBacking.Hugepages, domainName)
+	}
+
+	if desc.Numatune != nil {
+		e.collectDomainNumatune(ch, desc.Numatune, domainName)
+	}
+
+	// Reported along with the memory limits, which have to be raised for locked memory
+	if e.config.Collectors.Memtune {
+		var memoryLocked float64
+		if desc.MemoryBacking != nil && desc.MemoryBacking.Locked != nil {
+			memoryLocked = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainMemoryLockedDesc,
+			prometheus.GaugeValue,
+			memoryLocked,
+			domainName)
+	}
+}
+
+// collectDomainQemu reports the metrics which require to query the QEMU instance
+// running the domain for its CPU threads.
+func (e *LibvirtExporter) collectDomainQemu(ch chan<- prometheus.Metric, domain DomainHandle) error {
+	domainName, err := domain.GetName()
+	if err != nil {
+		return err
+	}
+
+	if !e.qemuMonitorAllowed(domainName) {
+		return nil
+	}
+
+	var threads []QemuThread
+	release := e.acquireRPC()
+	if e.config.QemuThreadsCommand != nil {
+		threads, err = e.config.QemuThreadsCommand.Query(domain)
+	} else {
+		threads, err = QueryQemuThreads(domain)
+	}
+	release()
+	if err != nil {
+		return err
+	}
+
+	if e.config.Collectors.StealTime {
+		if err = e.CollectDomainStealTime(ch, domainName, threads, e.config.Collectors.StealTimeAggregateOnly); err != nil {
+			e.countCollectorError("steal_time")
+		}
+		e.CollectDomainVcpuNodes(ch, domainName, threads)
+	}
+
+	if e.config.Collectors.QemuProcess {
+		if err = e.CollectQemuProcess(ch, domainName, threads); err != nil {
+			log.Printf("Error fetching QEMU process metrics of the domain %s: %v\n", domainName, err)
+			e.countCollectorError("qemu_process")
+		}
+	}
+
+	if e.config.Collectors.KVMDebugfs {
+		if err = e.CollectDomainHaltPolling(ch, domainName, threads); err != nil {
+			log.Printf("Error fetching the halt-polling statistics of the domain %s: %v\n", domainName, err)
+			e.countCollectorError("kvm_debugfs")
+		}
+	}
+
+	return nil
+}
+
+// collectDomainInfo reports the general information about the domain.
+func (e *LibvirtExporter) collectDomainInfo(ch chan<- prometheus.Metric, domain DomainHandle, stat libvirt.DomainStats, domainName string) error {
+	var info *libvirt.DomainInfo
+	err := e.callLibvirt(func() (err error) {
+		info, err = domain.GetInfo()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainInfoMaxMemDesc,
+		prometheus.GaugeValue,
+		float64(info.MaxMem)*1024,
 		domainName)
 	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatUnusedDesc,
-		prometheus.CounterValue,
-		float64(MemoryStats.Unused),
+		e.libvirtDomainInfoMemoryUsageDesc,
+		prometheus.GaugeValue,
+		float64(info.Memory)*1024,
 		domainName)
 	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatAvailableDesc,
-		prometheus.CounterValue,
-		float64(MemoryStats.Available),
+		e.libvirtDomainInfoNrVirtCPUDesc,
+		prometheus.GaugeValue,
+		float64(info.NrVirtCpu),
 		domainName)
 	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatActualBaloonDesc,
+		e.libvirtDomainInfoCPUTimeDesc,
 		prometheus.CounterValue,
-		float64(MemoryStats.ActualBalloon),
+		float64(info.CpuTime)/1e9,
 		domainName)
+
+	if stat.Cpu != nil {
+		if stat.Cpu.UserSet {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainInfoCPUUserTimeDesc,
+				prometheus.CounterValue,
+				float64(stat.Cpu.User)/1e9,
+				domainName)
+		}
+
+		if stat.Cpu.SystemSet {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainInfoCPUSystemTimeDesc,
+				prometheus.CounterValue,
+				float64(stat.Cpu.System)/1e9,
+				domainName)
+		}
+	}
+
 	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatRssDesc,
+		e.libvirtDomainInfoVirDomainState,
 		prometheus.CounterValue,
-		float64(MemoryStats.Rss),
+		float64(info.State),
 		domainName)
+
+	domainUUID, err := domain.GetUUIDString()
+	if err != nil {
+		return err
+	}
+
 	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatUsableDesc,
-		prometheus.CounterValue,
-		float64(MemoryStats.Usable),
+		e.libvirtDomainStateSinceDesc,
+		prometheus.GaugeValue,
+		float64(e.stateSince(domainUUID, info.State).UnixNano())/1e9,
 		domainName)
+
+	// The usage is only known starting from the second scrape of the domain
+	if usage, ok := e.cpuUsagePercent(domainUUID, info.CpuTime, uint(info.NrVirtCpu)); ok {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainCPUUsagePercentDesc,
+			prometheus.GaugeValue,
+			usage,
+			domainName)
+	}
+
+	return nil
+}
+
+// collectDomainCPUModel reports the CPU model of the domain, whether it has nested
+// virtualization, its CPU topology if explicitly configured and, if enabled, its CPU features.
+func (e *LibvirtExporter) collectDomainCPUModel(ch chan<- prometheus.Metric, cpu *libvirt_schema.CPU, domainName string) {
 	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatDiskCachesDesc,
-		prometheus.CounterValue,
-		float64(MemoryStats.DiskCaches),
+		e.libvirtDomainCPUModelInfoDesc,
+		prometheus.GaugeValue,
+		1,
+		domainName,
+		cpu.Mode,
+		strings.TrimSpace(cpu.Model.Name))
+
+	var nestedVirt float64
+	if nestedVirtEnabled(cpu.Features) {
+		nestedVirt = 1
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainNestedVirtDesc,
+		prometheus.GaugeValue,
+		nestedVirt,
 		domainName)
+
+	if topology := cpu.Topology; topology != nil {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainCPUTopologyInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			domainName,
+			strconv.FormatUint(uint64(topology.Sockets), 10),
+			strconv.FormatUint(uint64(topology.Cores), 10),
+			strconv.FormatUint(uint64(topology.Threads), 10))
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainCPUTopologyVcpusDesc,
+			prometheus.GaugeValue,
+			float64(topologyVcpus(topology)),
+			domainName)
+	}
+
+	if !e.config.Collectors.CPUFeatures {
+		return
+	}
+
+	for _, feature := range cpu.Features {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainCPUFeatureDesc,
+			prometheus.GaugeValue,
+			1,
+			domainName,
+			feature.Name,
+			feature.Policy)
+	}
+}
+
+// nestedVirtEnabled returns whether the Intel (vmx) or AMD (svm) virtualization
+// extensions are exposed to the domain by its CPU features. A feature without
+// policy is required.
+func nestedVirtEnabled(features []libvirt_schema.CPUFeature) bool {
+	for _, feature := range features {
+		if feature.Name != "vmx" && feature.Name != "svm" {
+			continue
+		}
+
+		switch feature.Policy {
+		case "", "require", "force", "optional":
+			return true
+		}
+	}
+
+	return false
+}
+
+// topologyVcpus returns the number of vCPUs of a CPU topology. The dies, only
+// set on recent libvirt versions, default to one per socket.
+func topologyVcpus(topology *libvirt_schema.CPUTopology) uint {
+	dies := topology.Dies
+	if dies == 0 {
+		dies = 1
+	}
+
+	return topology.Sockets * dies * topology.Cores * topology.Threads
+}
+
+// collectDomainGraphics reports the graphical consoles of the domain. With autoport,
+// the port is -1 until the domain is started and QEMU allocated one, in which case
+// only the info metric is reported.
+func (e *LibvirtExporter) collectDomainGraphics(ch chan<- prometheus.Metric, graphics []libvirt_schema.Graphics, domainName string) {
+	seen := make(map[string]bool)
+	for _, g := range graphics {
+		// Only the first console of each type is reported to keep the series unique
+		if seen[g.Type] {
+			continue
+		}
+		seen[g.Type] = true
+
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainGraphicsInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			domainName,
+			g.Type)
+
+		if g.Port > 0 {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainGraphicsPortDesc,
+				prometheus.GaugeValue,
+				float64(g.Port),
+				domainName,
+				g.Type)
+		}
+	}
+}
+
+// collectDomainLaunchSecurity reports whether the domain uses AMD SEV and, for the
+// running ones, their launch measurement when the hypervisor provides it.
+func (e *LibvirtExporter) collectDomainLaunchSecurity(ch chan<- prometheus.Metric, domain DomainHandle, stat libvirt.DomainStats, desc *libvirt_schema.Domain, domainName string) {
+	sev := desc.LaunchSecurity != nil && strings.HasPrefix(desc.LaunchSecurity.Type, "sev")
+
+	var sevEnabled float64
+	if sev {
+		sevEnabled = 1
+	}
 	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatUsedPercentDesc,
-		prometheus.CounterValue,
-		usedPercent,
+		e.libvirtDomainSEVEnabledDesc,
+		prometheus.GaugeValue,
+		sevEnabled,
 		domainName)
 
-	return nil
+	if !sev || stat.State == nil || stat.State.State != libvirt.DOMAIN_RUNNING {
+		return
+	}
+
+	var params *libvirt.DomainLaunchSecurityParameters
+	err := e.callLibvirt(func() (err error) {
+		params, err = domain.GetLaunchSecurityInfo(0)
+		return err
+	})
+	if err != nil {
+		if !isUnsupportedError(err) {
+			logLibvirtError(err)
+		}
+
+		return
+	}
+
+	if !params.SEVMeasurementSet {
+		return
+	}
+
+	policy := strings.TrimSpace(desc.LaunchSecurity.Policy)
+	if params.SEVPolicySet {
+		policy = fmt.Sprintf("0x%04x", params.SEVPolicy)
+	}
+
+	var apiVersion string
+	if params.SEVAPIMajorSet && params.SEVAPIMinorSet {
+		apiVersion = fmt.Sprintf("%d.%d", params.SEVAPIMajor, params.SEVAPIMinor)
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainSEVInfoDesc,
+		prometheus.GaugeValue,
+		1,
+		domainName,
+		params.SEVMeasurement,
+		policy,
+		apiVersion)
+}
+
+// secureBootEnabled returns whether the domain boots with UEFI Secure Boot enforced,
+// that is with firmware supporting it and with the Microsoft keys enrolled. A secure
+// loader only means that the firmware requires SMM, which the Secure Boot firmware
+// builds need but which doesn't enforce anything by itself.
+func secureBootEnabled(domainOS libvirt_schema.OS) bool {
+	var secureBoot, enrolledKeys bool
+	for _, feature := range domainOS.FirmwareFeatures {
+		switch feature.Name {
+		case "secure-boot":
+			secureBoot = feature.Enabled == "yes"
+		case "enrolled-keys":
+			enrolledKeys = feature.Enabled == "yes"
+		}
+	}
+
+	return secureBoot && enrolledKeys
+}
+
+// guestAgentConnected returns 1 if the QEMU guest agent is connected to its channel,
+// 0 otherwise. The second return value is false when the domain has no guest agent
+// channel or libvirt doesn't know its state, e.g. because the domain isn't running.
+func guestAgentConnected(channels []libvirt_schema.Channel) (float64, bool) {
+	for _, channel := range channels {
+		if channel.Target.Name != "org.qemu.guest_agent.0" {
+			continue
+		}
+
+		switch channel.Target.State {
+		case "connected":
+			return 1, true
+		case "disconnected":
+			return 0, true
+		default:
+			return 0, false
+		}
+	}
+
+	return 0, false
+}
+
+// collectDomainBootOrder reports the boot devices of the domain, configured either
+// with the legacy <boot dev=.../> elements of <os>, in which case their order is the
+// one of the elements, or with the <boot order=.../> element of each device.
+// libvirt doesn't allow mixing both.
+func (e *LibvirtExporter) collectDomainBootOrder(ch chan<- prometheus.Metric, desc *libvirt_schema.Domain, domainName string) {
+	report := func(device string, order uint) {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainBootOrderInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			domainName,
+			device,
+			strconv.FormatUint(uint64(order), 10))
+	}
+
+	for i, boot := range desc.OS.Boots {
+		report(boot.Dev, uint(i+1))
+	}
+
+	for _, disk := range desc.Devices.Disks {
+		if disk.Boot != nil && disk.Target.Device != "" {
+			report(disk.Target.Device, disk.Boot.Order)
+		}
+	}
+
+	for _, iface := range desc.Devices.Interfaces {
+		if iface.Boot != nil && iface.Target.Device != "" {
+			report(iface.Target.Device, iface.Boot.Order)
+		}
+	}
+
+	for _, hostdev := range desc.Devices.Hostdevs {
+		if hostdev.Boot == nil {
+			continue
+		}
+
+		if address, ok := hostdevAddress(hostdev); ok {
+			report(address, hostdev.Boot.Order)
+		}
+	}
+}
+
+// collectDomainVideos reports the video devices of the domain. The video memory is
+// only reported by the models which have one, e.g. not by virtio.
+func (e *LibvirtExporter) collectDomainVideos(ch chan<- prometheus.Metric, videos []libvirt_schema.Video, domainName string) {
+	for i, video := range videos {
+		index := strconv.Itoa(i)
+
+		var heads string
+		if video.Model.Heads > 0 {
+			heads = strconv.FormatUint(uint64(video.Model.Heads), 10)
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainVideoInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			domainName,
+			index,
+			video.Model.Type,
+			heads)
+
+		// In KiB
+		if video.Model.VRAM > 0 {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainVideoVRAMBytesDesc,
+				prometheus.GaugeValue,
+				float64(video.Model.VRAM)*1024,
+				domainName,
+				index)
+		}
+	}
+}
+
+// collectDomainNumatune reports the host NUMA nodes the memory of the domain is bound to,
+// as a whole and for each guest NUMA node. The nodesets are kept as libvirt formats them,
+// e.g. "0-1,^1". libvirt defaults to the strict mode.
+func (e *LibvirtExporter) collectDomainNumatune(ch chan<- prometheus.Metric, numatune *libvirt_schema.Numatune, domainName string) {
+	if numatune.Memory != nil {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainNumatuneInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			domainName,
+			numatuneMode(numatune.Memory.Mode),
+			numatune.Memory.Nodeset)
+	}
+
+	for _, memnode := range numatune.MemNodes {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainNumatuneMemnodeInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			domainName,
+			memnode.CellID,
+			numatuneMode(memnode.Mode),
+			memnode.Nodeset)
+	}
+}
+
+// numatuneMode returns the NUMA memory mode, libvirt's default when it is unset.
+func numatuneMode(mode string) string {
+	if mode == "" {
+		return "strict"
+	}
+
+	return mode
+}
+
+// collectDomainHugepages reports the sizes of the hugepages backing the memory of the
+// domain. Different sizes can be configured for different guest NUMA nodes.
+func (e *LibvirtExporter) collectDomainHugepages(ch chan<- prometheus.Metric, hugepages *libvirt_schema.Hugepages, domainName string) {
+	if len(hugepages.Pages) == 0 {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainHugepageBackingInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			domainName,
+			"default")
+
+		return
+	}
+
+	var largest uint64
+	seen := make(map[uint64]bool)
+	for _, page := range hugepages.Pages {
+		size, ok := scaledBytes(page.Size, page.Unit)
+		if !ok || seen[size] {
+			continue
+		}
+		seen[size] = true
+
+		if size > largest {
+			largest = size
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainHugepageBackingInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			domainName,
+			strconv.FormatUint(size, 10))
+	}
+
+	if largest > 0 {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainHugepagePageSizeDesc,
+			prometheus.GaugeValue,
+			float64(largest),
+			domainName)
+	}
+}
+
+// scaledBytes converts a size of the domain XML to bytes, as libvirt interprets its
+// unit: KiB by default, powers of 1000 for the units ending in B, such as KB, and
+// powers of 1024 otherwise. The second return value is false for unknown units.
+func scaledBytes(value uint64, unit string) (uint64, bool) {
+	switch strings.ToLower(unit) {
+	case "b", "bytes":
+		return value, true
+	case "kb":
+		return value * 1000, true
+	case "", "k", "kib":
+		return value << 10, true
+	case "mb":
+		return value * 1000 * 1000, true
+	case "m", "mib":
+		return value << 20, true
+	case "gb":
+		return value * 1000 * 1000 * 1000, true
+	case "g", "gib":
+		return value << 30, true
+	case "tb":
+		return value * 1000 * 1000 * 1000 * 1000, true
+	case "t", "tib":
+		return value << 40, true
+	default:
+		return 0, false
+	}
+}
+
+// hostdevAddress returns the address of a PCI host device in the usual
+// domain:bus:slot.function form, or the UUID of a mediated device. The second
+// return value is false for other types of host devices (USB, SCSI, ...).
+func hostdevAddress(hostdev libvirt_schema.Hostdev) (string, bool) {
+	switch hostdev.Type {
+	case "pci":
+		var parts [4]uint64
+		for i, s := range []string{hostdev.Source.Address.Domain, hostdev.Source.Address.Bus, hostdev.Source.Address.Slot, hostdev.Source.Address.Function} {
+			value, err := strconv.ParseUint(s, 0, 16)
+			if err != nil {
+				return "", false
+			}
+			parts[i] = value
+		}
+
+		return fmt.Sprintf("%04x:%02x:%02x.%x", parts[0], parts[1], parts[2], parts[3]), true
+	case "mdev":
+		return hostdev.Source.Address.UUID, hostdev.Source.Address.UUID != ""
+	default:
+		return "", false
+	}
+}
+
+// collectDomainBlockStats reports the statistics of the block devices of the domain.
+func (e *LibvirtExporter) collectDomainBlockStats(ch chan<- prometheus.Metric, stat libvirt.DomainStats, desc *libvirt_schema.Domain, domainName string) {
+	var DiskSource string
+
+	// Requests and bytes of all the block devices, for the domain totals
+	var totalRequests, totalBytes uint64
+
+	blocks, backingImages := splitBackingImages(stat.Block)
+
+	// Report block device statistics.
+	for _, disk := range blocks {
+		if disk.Name == "hdc" {
+			continue
+		}
+
+		totalRequests += blockStatsTotal(disk.RdReqsSet, disk.RdReqs, disk.WrReqsSet, disk.WrReqs)
+		totalBytes += blockStatsTotal(disk.RdBytesSet, disk.RdBytes, disk.WrBytesSet, disk.WrBytes)
+
+		/*  "block.<num>.path" - string describing the source of block device <num>,
+		    if it is a file or block device (omitted for network
+		    sources and drives with no media inserted). For network device (i.e. rbd) take from xml. */
+		DiskSource = disk.Path
+		if !disk.PathSet {
+			for _, dev := range desc.Devices.Disks {
+				if dev.Target.Device == disk.Name {
+					DiskSource = dev.Source.Name
+
+					break
+				}
+			}
+		}
+
+		// https://libvirt.org/html/libvirt-libvirt-domain.html#virConnectGetAllDomainStats
+		if disk.RdBytesSet {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainBlockRdBytesDesc,
+				prometheus.CounterValue,
+				float64(disk.RdBytes),
+				domainName,
+				DiskSource,
+				disk.Name)
+		}
+
+		if disk.RdReqsSet {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainBlockRdReqDesc,
+				prometheus.CounterValue,
+				float64(disk.RdReqs),
+				domainName,
+				DiskSource,
+				disk.Name)
+		}
+
+		if disk.RdTimesSet {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainBlockRdTotalTimesDesc,
+				prometheus.CounterValue,
+				float64(disk.RdTimes)/1e9,
+				domainName,
+				DiskSource,
+				disk.Name)
+		}
+
+		if e.config.LegacyMetrics && disk.RdBytesSet {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtLegacyDomainBlockRdTotalTimesDesc,
+				prometheus.CounterValue,
+				float64(disk.RdBytes)/1e9,
+				domainName,
+				DiskSource,
+				disk.Name)
+		}
+
+		if disk.WrBytesSet {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainBlockWrBytesDesc,
+				prometheus.CounterValue,
+				float64(disk.WrBytes),
+				domainName,
+				DiskSource,
+				disk.Name)
+		}
+
+		if disk.WrReqsSet {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainBlockWrReqDesc,
+				prometheus.CounterValue,
+				float64(disk.WrReqs),
+				domainName,
+				DiskSource,
+				disk.Name)
+		}
+
+		if disk.WrTimesSet {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainBlockWrTotalTimesDesc,
+				prometheus.CounterValue,
+				float64(disk.WrTimes)/1e9,
+				domainName,
+				DiskSource,
+				disk.Name)
+		}
+
+		if disk.FlReqsSet {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainBlockFlushReqDesc,
+				prometheus.CounterValue,
+				float64(disk.FlReqs),
+				domainName,
+				DiskSource,
+				disk.Name)
+		}
+
+		if disk.FlTimesSet {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainBlockFlushTotalTimesDesc,
+				prometheus.CounterValue,
+				float64(disk.FlTimes),
+				domainName,
+				DiskSource,
+				disk.Name)
+		}
+
+		if disk.AllocationSet {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainBlockAllocationDesc,
+				prometheus.CounterValue,
+				float64(disk.Allocation),
+				domainName,
+				DiskSource,
+				disk.Name)
+		}
+
+		if disk.CapacitySet {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainBlockCapacityDesc,
+				prometheus.CounterValue,
+				float64(disk.Capacity),
+				domainName,
+				DiskSource,
+				disk.Name)
+		}
+
+		if disk.PhysicalSet {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainBlockPhysicalSizeDesc,
+				prometheus.CounterValue,
+				float64(disk.Physical),
+				domainName,
+				DiskSource,
+				disk.Name)
+		}
+
+		if disk.CapacitySet && disk.PhysicalSet {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainBlockOvercommitDesc,
+				prometheus.GaugeValue,
+				float64(disk.Capacity)-float64(disk.Physical),
+				domainName,
+				DiskSource,
+				disk.Name)
+		}
+	}
+
+	for _, image := range backingImages {
+		if !e.config.Collectors.BlockBacking || !image.CapacitySet {
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainBlockBackingCapacityDesc,
+			prometheus.GaugeValue,
+			float64(image.Capacity),
+			domainName,
+			image.Name,
+			strconv.FormatUint(uint64(image.BackingIndex), 10))
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainBlockTotalRequestsDesc,
+		prometheus.CounterValue,
+		float64(totalRequests),
+		domainName)
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainBlockTotalBytesDesc,
+		prometheus.CounterValue,
+		float64(totalBytes),
+		domainName)
+
+	// Report the depth of the backing chains, the driver settings and the guest-visible
+	// properties of the disks, as described by the domain XML.
+	for _, dev := range desc.Devices.Disks {
+		if dev.Target.Device == "" {
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainBlockBackingChainDepthDesc,
+			prometheus.GaugeValue,
+			float64(backingChainDepth(dev.BackingStore)),
+			domainName,
+			dev.Target.Device)
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainBlockDriverInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			domainName,
+			dev.Target.Device,
+			dev.Driver.Cache,
+			dev.Driver.IO,
+			dev.Driver.Discard)
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainBlockInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			domainName,
+			dev.Target.Device,
+			dev.Serial)
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainBlockFlagsInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			domainName,
+			dev.Target.Device,
+			strconv.FormatBool(dev.ReadOnly != nil),
+			strconv.FormatBool(dev.Shareable != nil))
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainBlockLogicalBlockSizeDesc,
+			prometheus.GaugeValue,
+			float64(blockSizeOrDefault(dev.BlockIO.LogicalBlockSize)),
+			domainName,
+			dev.Target.Device)
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainBlockPhysicalBlockSizeDesc,
+			prometheus.GaugeValue,
+			float64(blockSizeOrDefault(dev.BlockIO.PhysicalBlockSize)),
+			domainName,
+			dev.Target.Device)
+	}
+}
+
+// blockStatsTotal returns the sum of the read and write statistics of a block
+// device, leaving out the ones libvirt didn't report.
+func blockStatsTotal(readSet bool, read uint64, writeSet bool, write uint64) uint64 {
+	var total uint64
+	if readSet {
+		total += read
+	}
+	if writeSet {
+		total += write
+	}
+
+	return total
+}
+
+// blockSizeOrDefault returns the given block size, or the 512 bytes sectors
+// QEMU presents to the guest when the domain XML doesn't set one.
+func blockSizeOrDefault(size uint) uint {
+	if size == 0 {
+		return 512
+	}
+
+	return size
+}
+
+// collectDomainQemuBlockStats reports the block device statistics which are only
+// available from QEMU. The devices are matched with the disks of the domain XML by alias.
+// The latencies are only reported for the devices with latency accounting intervals.
+func (e *LibvirtExporter) collectDomainQemuBlockStats(ch chan<- prometheus.Metric, domain DomainHandle, desc *libvirt_schema.Domain, domainName string) error {
+	var blockStats []QemuBlockStats
+	err := e.callLibvirt(func() (err error) {
+		blockStats, err = QueryQemuBlockStats(domain)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	targets := make(map[string]string, len(desc.Devices.Disks))
+	for _, disk := range desc.Devices.Disks {
+		if disk.Alias.Name != "" {
+			targets[disk.Alias.Name] = disk.Target.Device
+		}
+	}
+
+	for _, blockStat := range blockStats {
+		target, ok := targets[blockStat.Alias()]
+		if !ok {
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainBlockRdMergesDesc,
+			prometheus.CounterValue,
+			float64(blockStat.Stats.RdMerged),
+			domainName,
+			target)
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainBlockWrMergesDesc,
+			prometheus.CounterValue,
+			float64(blockStat.Stats.WrMerged),
+			domainName,
+			target)
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainBlockInvalidRdReqDesc,
+			prometheus.CounterValue,
+			float64(blockStat.Stats.InvalidRdOps),
+			domainName,
+			target)
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainBlockInvalidWrReqDesc,
+			prometheus.CounterValue,
+			float64(blockStat.Stats.InvalidWrOps),
+			domainName,
+			target)
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainBlockInvalidFlushReqDesc,
+			prometheus.CounterValue,
+			float64(blockStat.Stats.InvalidFlushOps),
+			domainName,
+			target)
+
+		// Not reported until the first request to the device
+		if blockStat.Stats.IdleTimeNs != nil {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainBlockIdleTimeDesc,
+				prometheus.GaugeValue,
+				float64(*blockStat.Stats.IdleTimeNs)/1e9,
+				domainName,
+				target)
+		}
+
+		for _, timed := range blockStat.Stats.TimedStats {
+			interval := strconv.Itoa(timed.IntervalLength) + "s"
+
+			for _, latency := range []struct {
+				desc          *prometheus.Desc
+				min, max, avg uint64
+			}{
+				{e.libvirtDomainBlockRdLatencyDesc, timed.MinRdLatencyNs, timed.MaxRdLatencyNs, timed.AvgRdLatencyNs},
+				{e.libvirtDomainBlockWrLatencyDesc, timed.MinWrLatencyNs, timed.MaxWrLatencyNs, timed.AvgWrLatencyNs},
+				{e.libvirtDomainBlockFlushLatencyDesc, timed.MinFlushLatencyNs, timed.MaxFlushLatencyNs, timed.AvgFlushLatencyNs},
+			} {
+				ch <- prometheus.MustNewConstMetric(latency.desc, prometheus.GaugeValue, float64(latency.min)/1e9, domainName, target, interval, "min")
+				ch <- prometheus.MustNewConstMetric(latency.desc, prometheus.GaugeValue, float64(latency.max)/1e9, domainName, target, interval, "max")
+				ch <- prometheus.MustNewConstMetric(latency.desc, prometheus.GaugeValue, float64(latency.avg)/1e9, domainName, target, interval, "avg")
+			}
+		}
+	}
+
+	return nil
+}
+
+// collectDomainBlkio reports the proportional block I/O weights of the domain, as a
+// whole and for each host device with its own weight.
+func (e *LibvirtExporter) collectDomainBlkio(ch chan<- prometheus.Metric, domain DomainHandle, domainName string) error {
+	var params *libvirt.DomainBlkioParameters
+	err := e.callLibvirt(func() (err error) {
+		params, err = domain.GetBlkioParameters(libvirt.DOMAIN_AFFECT_CURRENT)
+		return err
+	})
+	if isUnsupportedError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if params.WeightSet {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainBlkioWeightDesc,
+			prometheus.GaugeValue,
+			float64(params.Weight),
+			domainName)
+	}
+
+	if !params.DeviceWeightSet {
+		return nil
+	}
+
+	weights, err := parseBlkioDeviceWeights(params.DeviceWeight)
+	if err != nil {
+		return err
+	}
+
+	for _, weight := range weights {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainBlkioDeviceWeightDesc,
+			prometheus.GaugeValue,
+			float64(weight.weight),
+			domainName,
+			weight.device)
+	}
+
+	return nil
+}
+
+// collectDomainConfigHash reports the hash of the persistent XML description of the
+// domain, or of its live one for a transient domain. The secure information, such as
+// passwords, is left out of the description, so changing it doesn't change the hash.
+func (e *LibvirtExporter) collectDomainConfigHash(ch chan<- prometheus.Metric, domain DomainHandle, domainName string) error {
+	domainUUID, err := domain.GetUUIDString()
+	if err != nil {
+		return err
+	}
+
+	var xmlDesc string
+	err = e.callLibvirt(func() (err error) {
+		xmlDesc, err = domain.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainConfigHashDesc,
+		prometheus.GaugeValue,
+		float64(e.domainConfigHash(domainUUID, xmlDesc)),
+		domainName)
+
+	return nil
+}
+
+// collectDomainMemtune reports the memory limits of the domain. The unlimited ones,
+// which libvirt reports as DOMAIN_MEMORY_PARAM_UNLIMITED, are omitted.
+func (e *LibvirtExporter) collectDomainMemtune(ch chan<- prometheus.Metric, domain DomainHandle, domainName string) error {
+	var params *libvirt.DomainMemoryParameters
+	err := e.callLibvirt(func() (err error) {
+		params, err = domain.GetMemoryParameters(libvirt.DOMAIN_AFFECT_CURRENT)
+		return err
+	})
+	if isUnsupportedError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, limit := range []struct {
+		desc  *prometheus.Desc
+		set   bool
+		value uint64
+	}{
+		{e.libvirtDomainMemtuneHardLimitDesc, params.HardLimitSet, params.HardLimit},
+		{e.libvirtDomainMemtuneSoftLimitDesc, params.SoftLimitSet, params.SoftLimit},
+		{e.libvirtDomainMemtuneSwapHardLimitDesc, params.SwapHardLimitSet, params.SwapHardLimit},
+	} {
+		if !limit.set || limit.value >= libvirt.DOMAIN_MEMORY_PARAM_UNLIMITED {
+			continue
+		}
+
+		// In KiB
+		ch <- prometheus.MustNewConstMetric(
+			limit.desc,
+			prometheus.GaugeValue,
+			float64(limit.value)*1024,
+			domainName)
+	}
+
+	return nil
+}
+
+// blkioDeviceWeight is the block I/O weight of the domain on a host device.
+type blkioDeviceWeight struct {
+	device string
+	weight uint64
+}
+
+// parseBlkioDeviceWeights parses the device weights libvirt returns as a single
+// string alternating the device paths and their weights, e.g. "/dev/sda,500,/dev/sdb,300".
+func parseBlkioDeviceWeights(value string) ([]blkioDeviceWeight, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	fields := strings.Split(value, ",")
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("Malformed block I/O device weights %q", value)
+	}
+
+	weights := make([]blkioDeviceWeight, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		weight, err := strconv.ParseUint(fields[i+1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed block I/O device weights %q: %w", value, err)
+		}
+
+		weights = append(weights, blkioDeviceWeight{device: fields[i], weight: weight})
+	}
+
+	return weights, nil
+}
+
+// splitBackingImages separates the block devices from the images of their backing
+// chains, which libvirt reports under the same name right after the device.
+func splitBackingImages(blocks []libvirt.DomainStatsBlock) ([]libvirt.DomainStatsBlock, []libvirt.DomainStatsBlock) {
+	var (
+		devices       = make([]libvirt.DomainStatsBlock, 0, len(blocks))
+		backingImages []libvirt.DomainStatsBlock
+		seen          = make(map[string]bool, len(blocks))
+	)
+
+	for _, block := range blocks {
+		if seen[block.Name] {
+			backingImages = append(backingImages, block)
+
+			continue
+		}
+
+		seen[block.Name] = true
+		devices = append(devices, block)
+	}
+
+	return devices, backingImages
+}
+
+// collectDomainQMPCustom reports the metrics of --collector.qmp-custom. A command
+// rejected by QEMU, e.g. unknown to its version, only skips its own metrics, as do
+// the fields missing from its result.
+func (e *LibvirtExporter) collectDomainQMPCustom(ch chan<- prometheus.Metric, domain DomainHandle, domainName string) error {
+	for _, command := range e.config.QMPCustomCommands {
+		var result interface{}
+		err := e.callLibvirt(func() (err error) {
+			result, err = QueryQMPCustom(domain, command.Command)
+			return err
+		})
+		if _, ok := err.(libvirt.Error); ok {
+			return err
+		}
+		if err != nil {
+			log.Printf("Error running the QMP command %s on the domain %s: %v\n", command.Command, domainName, err)
+			e.countCollectorError("qmp_custom")
+
+			continue
+		}
+
+		for _, metric := range command.Metrics {
+			value, ok := resolveQMPPath(result, metric.Path)
+			if !ok {
+				continue
+			}
+
+			ch <- prometheus.MustNewConstMetric(
+				metric.desc,
+				prometheus.GaugeValue,
+				value,
+				domainName)
+		}
+	}
+
+	return nil
+}
+
+// collectDomainBlockJobs reports the progress of the block jobs (pull, commit, copy, ...)
+// running on the block devices of the domain. Devices without an active job are skipped.
+func (e *LibvirtExporter) collectDomainBlockJobs(ch chan<- prometheus.Metric, domain DomainHandle, stat libvirt.DomainStats, domainName string) {
+	blocks, _ := splitBackingImages(stat.Block)
+	for _, disk := range blocks {
+		var job *libvirt.DomainBlockJobInfo
+		err := e.callLibvirt(func() (err error) {
+			job, err = domain.GetBlockJobInfo(disk.Name, 0)
+			return err
+		})
+		if err != nil {
+			log.Printf("Error fetching the block job of the disk %s of the domain %s: %v\n", disk.Name, domainName, err)
+			e.countCollectorError("block_jobs")
+
+			continue
+		}
+
+		if job.Type == libvirt.DOMAIN_BLOCK_JOB_TYPE_UNKNOWN {
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainBlockJobCurDesc,
+			prometheus.GaugeValue,
+			float64(job.Cur),
+			domainName,
+			disk.Name)
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainBlockJobEndDesc,
+			prometheus.GaugeValue,
+			float64(job.End),
+			domainName,
+			disk.Name)
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainBlockJobTypeDesc,
+			prometheus.GaugeValue,
+			float64(job.Type),
+			domainName,
+			disk.Name)
+	}
+}
+
+// collectDomainInterfaceStats reports the statistics of the network interfaces of the domain.
+func (e *LibvirtExporter) collectDomainInterfaceStats(ch chan<- prometheus.Metric, stat libvirt.DomainStats, desc *libvirt_schema.Domain, domainName string) {
+	for _, iface := range stat.Net {
+		var (
+			SourceBridge           string
+			VirtualPortInterfaceID string
+		)
+
+		// Additional info for ovs network
+		for _, net := range desc.Devices.Interfaces {
+			if net.Target.Device == iface.Name {
+				SourceBridge = net.Source.Bridge
+				VirtualPortInterfaceID = net.Virtualport.Parameters.InterfaceID
+
+				break
+			}
+		}
+
+		if iface.RxBytesSet {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainInterfaceRxBytesDesc,
+				prometheus.CounterValue,
+				float64(iface.RxBytes),
+				domainName,
+				SourceBridge,
+				iface.Name,
+				VirtualPortInterfaceID)
+		}
+
+		if iface.RxPktsSet {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainInterfaceRxPacketsDesc,
+				prometheus.CounterValue,
+				float64(iface.RxPkts),
+				domainName,
+				SourceBridge,
+				iface.Name,
+				VirtualPortInterfaceID)
+		}
+
+		if iface.RxErrsSet {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainInterfaceRxErrsDesc,
+				prometheus.CounterValue,
+				float64(iface.RxErrs),
+				domainName,
+				SourceBridge,
+				iface.Name,
+				VirtualPortInterfaceID)
+		}
+
+		if iface.RxDropSet {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainInterfaceRxDropDesc,
+				prometheus.CounterValue,
+				float64(iface.RxDrop),
+				domainName,
+				SourceBridge,
+				iface.Name,
+				VirtualPortInterfaceID)
+		}
+
+		if iface.TxBytesSet {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainInterfaceTxBytesDesc,
+				prometheus.CounterValue,
+				float64(iface.TxBytes),
+				domainName,
+				SourceBridge,
+				iface.Name,
+				VirtualPortInterfaceID)
+		}
+
+		if iface.TxPktsSet {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainInterfaceTxPacketsDesc,
+				prometheus.CounterValue,
+				float64(iface.TxPkts),
+				domainName,
+				SourceBridge,
+				iface.Name,
+				VirtualPortInterfaceID)
+		}
+
+		if iface.TxErrsSet {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainInterfaceTxErrsDesc,
+				prometheus.CounterValue,
+				float64(iface.TxErrs),
+				domainName,
+				SourceBridge,
+				iface.Name,
+				VirtualPortInterfaceID)
+		}
+
+		if iface.TxDropSet {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainInterfaceTxDropDesc,
+				prometheus.CounterValue,
+				float64(iface.TxDrop),
+				domainName,
+				SourceBridge,
+				iface.Name,
+				VirtualPortInterfaceID)
+		}
+	}
+
+	// The link state is only known from the domain XML, where it is up unless stated
+	// otherwise. The vhost-user interfaces have no bridge but a socket.
+	for _, net := range desc.Devices.Interfaces {
+		if net.Target.Device == "" {
+			continue
+		}
+
+		linkUp := 1.0
+		if net.Link.State == "down" {
+			linkUp = 0.0
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainInterfaceLinkUpDesc,
+			prometheus.GaugeValue,
+			linkUp,
+			domainName,
+			net.Target.Device)
+
+		if net.Type == "vhostuser" {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainInterfaceVhostuserDesc,
+				prometheus.GaugeValue,
+				1,
+				domainName,
+				net.Target.Device,
+				net.Source.Path,
+				net.Source.Mode)
+		}
+	}
+}
+
+// collectDomainMemoryStats reports the memory statistics of the domain.
+func (e *LibvirtExporter) collectDomainMemoryStats(ch chan<- prometheus.Metric, domain DomainHandle, stat libvirt.DomainStats, desc *libvirt_schema.Domain, domainName string) {
+	var MemoryStats libvirt_schema.VirDomainMemoryStats
+
+	var memorystat []libvirt.DomainMemoryStat
+	err := e.callLibvirt(func() (err error) {
+		memorystat, err = domain.MemoryStats(uint32(libvirt.DOMAIN_MEMORY_STAT_NR), 0)
+		return err
+	})
+	if err == nil {
+		MemoryStats = MemoryStatCollect(&memorystat)
+	}
+
+	statsAvailable := 0.0
+	if guestMemoryStatsReported(memorystat) {
+		statsAvailable = 1.0
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainMemoryStatReportedDesc,
+		prometheus.GaugeValue,
+		statsAvailable,
+		domainName)
+
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainMemoryStatMajorfaultDesc,
+		prometheus.CounterValue,
+		float64(MemoryStats.MajorFault),
+		domainName)
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainMemoryStatMinorFaultDesc,
+		prometheus.CounterValue,
+		float64(MemoryStats.MinorFault),
+		domainName)
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainMemoryStatUnusedDesc,
+		prometheus.CounterValue,
+		float64(MemoryStats.Unused),
+		domainName)
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainMemoryStatAvailableDesc,
+		prometheus.CounterValue,
+		float64(MemoryStats.Available),
+		domainName)
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainMemoryStatActualBaloonDesc,
+		prometheus.CounterValue,
+		float64(MemoryStats.ActualBalloon),
+		domainName)
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainMemoryStatRssDesc,
+		prometheus.CounterValue,
+		float64(MemoryStats.Rss),
+		domainName)
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainMemoryStatUsableDesc,
+		prometheus.CounterValue,
+		float64(MemoryStats.Usable),
+		domainName)
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainMemoryStatDiskCachesDesc,
+		prometheus.CounterValue,
+		float64(MemoryStats.DiskCaches),
+		domainName)
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainMemoryStatSwapInDesc,
+		prometheus.CounterValue,
+		float64(MemoryStats.SwapIn),
+		domainName)
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainMemoryStatSwapOutDesc,
+		prometheus.CounterValue,
+		float64(MemoryStats.SwapOut),
+		domainName)
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainMemoryStatHugetlbPgAllocDesc,
+		prometheus.CounterValue,
+		float64(MemoryStats.HugetlbPgAlloc),
+		domainName)
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainMemoryStatHugetlbPgFailDesc,
+		prometheus.CounterValue,
+		float64(MemoryStats.HugetlbPgFail),
+		domainName)
+
+	// Omitted rather than reported as 0% when the guest doesn't provide the statistics
+	if usedPercent, ok := memoryUsedPercent(MemoryStats); ok {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtDomainMemoryStatUsedPercentDesc,
+			prometheus.CounterValue,
+			usedPercent,
+			domainName)
+	}
+
+	// The balloon size is only known for running domains, and the target from the XML description
+	target, ok := scaledBytes(desc.CurrentMemory.Value, desc.CurrentMemory.Unit)
+	if MemoryStats.ActualBalloon == 0 || desc.CurrentMemory.Value == 0 || !ok {
+		return
+	}
+
+	domainUUID, err := domain.GetUUIDString()
+	if err != nil {
+		return
+	}
+
+	stuck := 0.0
+	if e.balloonDeflateStuck(domainUUID, target, MemoryStats.ActualBalloon*1024) {
+		stuck = 1.0
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainBalloonDeflateStuckDesc,
+		prometheus.GaugeValue,
+		stuck,
+		domainName)
+}
+
+// guestMemoryStatsReported returns whether the memory statistics include any
+// reported by the balloon driver of the guest. The current balloon size and the
+// RSS are known to the hypervisor and returned even without it.
+func guestMemoryStatsReported(memorystat []libvirt.DomainMemoryStat) bool {
+	for _, domainmemorystat := range memorystat {
+		switch libvirt.DomainMemoryStatTags(domainmemorystat.Tag) {
+		case libvirt.DOMAIN_MEMORY_STAT_ACTUAL_BALLOON, libvirt.DOMAIN_MEMORY_STAT_RSS:
+		default:
+			return true
+		}
+	}
+
+	return false
+}
+
+// memoryUsedPercent returns the share of the memory available to the guest which it
+// can't reclaim without swapping. The second return value is false when the balloon
+// driver doesn't report the usable and available memory.
+func memoryUsedPercent(stats libvirt_schema.VirDomainMemoryStats) (float64, bool) {
+	if stats.Usable == 0 || stats.Available == 0 {
+		return 0, false
+	}
+
+	// Both values are sampled by the guest, don't let a skew produce a negative usage
+	if stats.Usable > stats.Available {
+		return 0, true
+	}
+
+	return (float64(stats.Available) - float64(stats.Usable)) / (float64(stats.Available) / float64(100)), true
+}
+
+// backingChainDepth returns the number of images in a <backingStore> chain.
+// An empty <backingStore/> element marks the end of the chain.
+func backingChainDepth(store *libvirt_schema.BackingStore) int {
+	depth := 0
+
+	for ; store != nil && store.Type != ""; store = store.BackingStore {
+		depth++
+	}
+
+	return depth
+}
+
+func MemoryStatCollect(memorystat *[]libvirt.DomainMemoryStat) libvirt_schema.VirDomainMemoryStats {
+	var MemoryStats libvirt_schema.VirDomainMemoryStats
+
+	for _, domainmemorystat := range *memorystat {
+		switch domainmemorystat.Tag {
+		case int32(libvirt.DOMAIN_MEMORY_STAT_MAJOR_FAULT):
+			MemoryStats.MajorFault = domainmemorystat.Val
+		case int32(libvirt.DOMAIN_MEMORY_STAT_MINOR_FAULT):
+			MemoryStats.MinorFault = domainmemorystat.Val
+		case int32(libvirt.DOMAIN_MEMORY_STAT_UNUSED):
+			MemoryStats.Unused = domainmemorystat.Val
+		case int32(libvirt.DOMAIN_MEMORY_STAT_AVAILABLE):
+			MemoryStats.Available = domainmemorystat.Val
+		case int32(libvirt.DOMAIN_MEMORY_STAT_ACTUAL_BALLOON):
+			MemoryStats.ActualBalloon = domainmemorystat.Val
+		case int32(libvirt.DOMAIN_MEMORY_STAT_RSS):
+			MemoryStats.Rss = domainmemorystat.Val
+		case int32(libvirt.DOMAIN_MEMORY_STAT_USABLE):
+			MemoryStats.Usable = domainmemorystat.Val
+		case int32(libvirt.DOMAIN_MEMORY_STAT_DISK_CACHES):
+			MemoryStats.DiskCaches = domainmemorystat.Val
+		case int32(libvirt.DOMAIN_MEMORY_STAT_SWAP_IN):
+			MemoryStats.SwapIn = domainmemorystat.Val
+		case int32(libvirt.DOMAIN_MEMORY_STAT_SWAP_OUT):
+			MemoryStats.SwapOut = domainmemorystat.Val
+		case int32(libvirt.DOMAIN_MEMORY_STAT_HUGETLB_PGALLOC):
+			MemoryStats.HugetlbPgAlloc = domainmemorystat.Val
+		case int32(libvirt.DOMAIN_MEMORY_STAT_HUGETLB_PGFAIL):
+			MemoryStats.HugetlbPgFail = domainmemorystat.Val
+		}
+	}
+
+	return MemoryStats
+}
+
+// MetadataLabel maps an element or attribute of the domain metadata to a label.
+type MetadataLabel struct {
+	Name      string
+	Namespace string
+	// Slash-separated element names, the last one may be an attribute prefixed with '@'
+	Path []string
+}
+
+var labelNameRegexp = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// ParseMetadataLabel parses a "labelname=namespace:path" mapping. The namespace is the XML
+// namespace URI of the metadata element, which may itself contain colons.
+func ParseMetadataLabel(mapping string) (MetadataLabel, error) {
+	var label MetadataLabel
+
+	nameEnd := strings.Index(mapping, "=")
+	if nameEnd <= 0 {
+		return label, fmt.Errorf("Malformed metadata label mapping %q, expected labelname=namespace:path", mapping)
+	}
+
+	label.Name = mapping[:nameEnd]
+	if !labelNameRegexp.MatchString(label.Name) || label.Name == "domain" {
+		return label, fmt.Errorf("Invalid label name %q in metadata label mapping %q", label.Name, mapping)
+	}
+
+	var err error
+	if label.Namespace, label.Path, err = parseMetadataPath(mapping[nameEnd+1:]); err != nil {
+		return label, fmt.Errorf("Malformed metadata label mapping %q: %w", mapping, err)
+	}
+
+	return label, nil
+}
+
+// parseMetadataPath parses a "namespace:path" metadata element reference.
+func parseMetadataPath(reference string) (string, []string, error) {
+	pathStart := strings.LastIndex(reference, ":")
+	if pathStart <= 0 || pathStart == len(reference)-1 {
+		return "", nil, fmt.Errorf("expected namespace:path")
+	}
+
+	path := strings.Split(strings.Trim(reference[pathStart+1:], "/"), "/")
+	for i, step := range path {
+		if step == "" || (strings.HasPrefix(step, "@") && i != len(path)-1) {
+			return "", nil, fmt.Errorf("invalid path %q", reference[pathStart+1:])
+		}
+	}
+
+	return reference[:pathStart], path, nil
+}
+
+// MetadataSelector selects the domains to collect by the value of an element or
+// attribute of their metadata.
+type MetadataSelector struct {
+	Element MetadataLabel
+	Value   string
+}
+
+// ParseMetadataSelector parses a "namespace:path=value" selector.
+func ParseMetadataSelector(selector string) (*MetadataSelector, error) {
+	valueStart := strings.LastIndex(selector, "=")
+	if valueStart <= 0 {
+		return nil, fmt.Errorf("Malformed metadata selector %q, expected namespace:path=value", selector)
+	}
+
+	namespace, path, err := parseMetadataPath(selector[:valueStart])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed metadata selector %q: %w", selector, err)
+	}
+
+	return &MetadataSelector{
+		Element: MetadataLabel{Namespace: namespace, Path: path},
+		Value:   selector[valueStart+1:],
+	}, nil
+}
+
+// Matches returns whether the metadata of the domain holds the selected value. Only
+// the metadata element of the namespace of the selector is fetched, with GetMetadata.
+func (s *MetadataSelector) Matches(domain DomainHandle) (bool, error) {
+	metadata, err := domain.GetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, s.Element.Namespace, libvirt.DOMAIN_AFFECT_CURRENT)
+	if libvirtErr, ok := err.(libvirt.Error); ok && libvirtErr.Code == libvirt.ERR_NO_DOMAIN_METADATA {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var element libvirt_schema.MetadataElement
+	if err = xml.Unmarshal([]byte(metadata), &element); err != nil {
+		return false, err
+	}
+
+	return s.Element.Resolve([]libvirt_schema.MetadataElement{element}) == s.Value, nil
+}
+
+// Resolve returns the value of the mapped element or attribute in the given domain
+// metadata elements, or an empty string when it is missing.
+func (l MetadataLabel) Resolve(elements []libvirt_schema.MetadataElement) string {
+	var current *libvirt_schema.MetadataElement
+
+	for _, step := range l.Path {
+		if strings.HasPrefix(step, "@") {
+			if current == nil {
+				return ""
+			}
+
+			for _, attr := range current.Attrs {
+				if attr.Name.Local == step[1:] {
+					return attr.Value
+				}
+			}
+
+			return ""
+		}
+
+		var next *libvirt_schema.MetadataElement
+
+		for i := range elements {
+			if elements[i].XMLName.Local == step && elements[i].XMLName.Space == l.Namespace {
+				next = &elements[i]
+
+				break
+			}
+		}
+
+		if next == nil {
+			return ""
+		}
+
+		current = next
+		elements = current.Children
+	}
+
+	return strings.TrimSpace(current.Text)
+}
+
+// LibvirtExporter implements a Prometheus exporter for libvirt state.
+type LibvirtExporter struct {
+	// Accessed atomically, keep 64-bit aligned
+	scrapesInFlight  int64
+	scrapesTotal     uint64
+	domainsTruncated uint64
+
+	uri    string
+	config Config
+
+	// Descriptors of the metrics, under the namespace of the exporter
+	*metrics
+
+	// Connection kept open between scrapes and its statistics
+	conn        ConnectHandle
+	readOnly    bool
+	qemuMonitor bool
+
+	// Whether the connection is the read-only one opened by --libvirt.read-only-first,
+	// and whether a domain needs the QEMU monitor and thus a read-write connection
+	readOnlyFirst   bool
+	readWriteNeeded bool
+
+	connectAttempted bool
+	reconnects       uint64
+	connectFailures  map[string]uint64
+	connectDuration  time.Duration
+	connMutex        sync.Mutex
+
+	// Result of the last health check of the connection, and when it last succeeded,
+	// guarded by connMutex
+	healthy     bool
+	lastHealthy time.Time
+
+	// Memory and CPUs of the host, fetched once per connection and guarded by connMutex
+	nodeInfo *libvirt.NodeInfo
+
+	// Shared with the exporters of other targets to bound concurrent scrapes, may be nil
+	scrapeSlots chan struct{}
+
+	// CPU time of every domain seen at the previous scrape, keyed by UUID
+	cpuTimes      map[string]cpuTimeSample
+	cpuTimesMutex sync.Mutex
+
+	// State of every domain seen at the previous scrape, keyed by UUID
+	states      map[string]stateSample
+	statesMutex sync.Mutex
+
+	// Balloon sizes of every domain above its target at the last scrapes, keyed by UUID
+	balloons      map[string]balloonHistory
+	balloonsMutex sync.Mutex
+
+	// Hash of the persistent XML description of every domain, keyed by UUID, and the
+	// seed of the cheaper hash telling whether the description changed
+	configHashes      map[string]configHash
+	configHashSeed    maphash.Seed
+	configHashesMutex sync.Mutex
+
+	// Errors of the collectors which don't fail the domain, by collector
+	collectorErrors      map[string]uint64
+	collectorErrorsMutex sync.Mutex
+
+	// Event callbacks registered on the current connection, and the events
+	// received through them, keyed by domain name
+	eventCallbacks []int
+	watchdogEvents map[string]uint64
+	panicEvents    map[string]uint64
+	eventsMutex    sync.Mutex
+
+	// Latest collection from libvirt, shared by the concurrent scrapes and,
+	// with a cache TTL, by the following ones
+	collection      *collection
+	collectionMutex sync.Mutex
+
+	// Latest collection made in the background, what stops it and the health checks,
+	// and what tells when they have stopped
+	snapshot        atomic.Pointer[collection]
+	stopBackground  chan struct{}
+	stopHealthCheck chan struct{}
+	backgroundDone  chan struct{}
+	healthCheckDone chan struct{}
+	backgroundMutex sync.Mutex
+}
+
+// collection holds the metrics collected from libvirt by a scrape. The other fields
+// must only be read once done is closed.
+type collection struct {
+	done    chan struct{}
+	metrics []prometheus.Metric
+	err     error
+	time    time.Time
+}
+
+// expired returns whether the collection can't be served anymore, a collection in
+// progress never is.
+func (c *collection) expired(ttl time.Duration) bool {
+	select {
+	case <-c.done:
+		return c.err != nil || time.Since(c.time) >= ttl
+	default:
+		return false
+	}
+}
+
+// cpuTimeSample holds the CPU time of a domain, in ns, and when it was read.
+type cpuTimeSample struct {
+	cpuTime   uint64
+	timestamp time.Time
+}
+
+// stateSample holds the state of a domain, since when it is in that state and
+// when it was last seen.
+type stateSample struct {
+	state     libvirt.DomainState
+	since     time.Time
+	timestamp time.Time
+}
+
+// balloonHistoryLength is the number of scrapes over which the balloon of a domain
+// has to stay above its target without shrinking to be reported as stuck.
+const balloonHistoryLength = 3
+
+// balloonHistory holds the balloon sizes of a domain, in bytes, at the last scrapes
+// where they were above the target, and when it was last seen.
+type balloonHistory struct {
+	sizes     []uint64
+	timestamp time.Time
+}
+
+// configHash holds the hash of the persistent XML description of a domain, the
+// maphash of the description it was computed from, and when it was last seen.
+type configHash struct {
+	key       uint64
+	hash      uint64
+	timestamp time.Time
+}
+
+// Config holds the settings of the exporter which are common to all libvirt URIs.
+type Config struct {
+	// Credentials for SASL login
+	Login    string
+	Password string
+
+	// Namespace (prefix) of the exported metrics, "libvirt" when empty
+	Namespace string
+
+	// Domain metadata elements exposed as labels of the metadata metric
+	MetadataLabels []MetadataLabel
+
+	// Groups of metrics to collect
+	Collectors Collectors
+
+	// Only open read-only connections, which can't use the QEMU monitor passthrough
+	ReadOnly bool
+
+	// Open a read-only connection first, until a domain needs the QEMU monitor
+	ReadOnlyFirst bool
+
+	// Disable the verification of the certificate of libvirtd for TLS connections
+	TLSInsecure bool
+
+	// Shared by all exporters to bound the number of concurrent libvirt calls, may be nil
+	RPCSlots chan struct{}
+
+	// Metrics collected from libvirt are served to the scrapes within this
+	// duration instead of collecting them again, zero disables it
+	CacheTTL time.Duration
+
+	// Collect the metrics from libvirt in the background at this interval, the
+	// scrapes then serve the latest collection. Zero collects them during the scrapes.
+	BackgroundInterval time.Duration
+
+	// Check that libvirt answers on the connection at this interval, reconnecting
+	// when it doesn't. Zero disables the health checks.
+	HealthCheckInterval time.Duration
+
+	// Also export the metrics under their former names and types, during the
+	// migration of the dashboards
+	LegacyMetrics bool
+
+	// Maximum number of domains collected per scrape, zero means no limit
+	MaxDomains int
+
+	// Domains whose QEMU monitor may be used, all of them when nil
+	QemuMonitorDomains *regexp.Regexp
+
+	// QMP command listing the CPU threads of QEMU, "query-cpus-fast" then "query-cpus" when nil
+	QemuThreadsCommand *QemuThreadsCommand
+
+	// QMP query commands whose results are exported, from --collector.qmp-custom
+	QMPCustomCommands []QMPCustomCommand
+
+	// Statistics groups requested for every domain, domainStatsTypes when zero
+	StatsGroups libvirt.DomainStatsTypes
+
+	// UUIDs of the only domains to collect, all of them when empty, and of the
+	// domains never to collect, in lower case
+	DomainUUIDAllowlist map[string]bool
+	DomainUUIDDenylist  map[string]bool
+
+	// Only collect the domains whose metadata matches, all of them when nil
+	MetadataSelector *MetadataSelector
+
+	// Opens the connections to libvirt, the libvirt library when nil
+	dialer dialer
+
+	// Where the sysfs of the host is mounted, /sys when empty
+	sysfsRoot string
+}
+
+// Collectors holds which groups of metrics are collected.
+type Collectors struct {
+	Info      bool
+	Block     bool
+	BlockJobs bool
+	Interface bool
+	Memory    bool
+	StealTime bool
+
+	// Only the total steal time of every domain, not the one of each vCPU
+	StealTimeAggregateOnly bool
+
+	// Capacity of the images of the backing chains, along with the block statistics
+	BlockBacking bool
+
+	// Resource usage of the QEMU processes, found the same way as the steal time
+	QemuProcess bool
+
+	// Metrics and labels derived from the XML description of the domains, which is
+	// costly to parse for large descriptions
+	DomainXML bool
+
+	// Halt-polling statistics of the vCPUs, read from the KVM debugfs as root
+	KVMDebugfs bool
+
+	// Per-feature series, disabled by default because of their cardinality
+	CPUFeatures bool
+
+	// Block device statistics only available from QEMU, one more QEMU monitor call per domain
+	QMPBlockStats bool
+
+	// Shut off domains, which only report their configuration (state, memory, vCPUs, devices)
+	IncludeInactive bool
+
+	// Capabilities of the host, two more calls per scrape
+	NodeCaps bool
+
+	// Watchdog and panic events, they require the libvirt event loop to be running
+	Events bool
+
+	// Migrations the host takes part in, one more call per active domain
+	Migrations bool
+
+	// Block I/O weights, one more call per domain with block I/O tuning
+	Blkio bool
+
+	// Memory limits, one more call per domain with memory tuning
+	Memtune bool
+
+	// Frequency of the host CPUs, read from the sysfs of the host running the exporter
+	NodeCPUFreq bool
+
+	// Hash of the persistent XML description, one more call per domain
+	ConfigHash bool
+}
+
+// Enabled returns the names of the enabled collectors, as used by the --collector.* flags.
+func (c Collectors) Enabled() []string {
+	var names []string
+	for _, collector := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"info", c.Info},
+		{"domain-xml", c.DomainXML},
+		{"block", c.Block},
+		{"block-jobs", c.BlockJobs},
+		{"block-backing", c.BlockBacking},
+		{"interface", c.Interface},
+		{"memory", c.Memory},
+		{"steal-time", c.StealTime},
+		{"qemu-process", c.QemuProcess},
+		{"kvm-debugfs", c.KVMDebugfs},
+		{"qmp-blockstats", c.QMPBlockStats},
+		{"node-caps", c.NodeCaps},
+		{"node-cpufreq", c.NodeCPUFreq},
+		{"include-inactive", c.IncludeInactive},
+		{"cpu-features", c.CPUFeatures},
+		{"events", c.Events},
+		{"migrations", c.Migrations},
+		{"blkio", c.Blkio},
+		{"memtune", c.Memtune},
+		{"config-hash", c.ConfigHash},
+	} {
+		if collector.enabled {
+			names = append(names, collector.name)
+		}
+	}
+
+	return names
+}
+
+// NewLibvirtExporter creates a new Prometheus exporter for libvirt.
+func NewLibvirtExporter(uri string, config Config) *LibvirtExporter {
+	namespace := config.Namespace
+	if namespace == "" {
+		namespace = "libvirt"
+	}
+
+	return &LibvirtExporter{
+		uri:             uri,
+		config:          config,
+		metrics:         newMetrics(namespace, config.MetadataLabels),
+		cpuTimes:        make(map[string]cpuTimeSample),
+		states:          make(map[string]stateSample),
+		balloons:        make(map[string]balloonHistory),
+		configHashes:    make(map[string]configHash),
+		configHashSeed:  maphash.MakeSeed(),
+		connectFailures: make(map[string]uint64),
+		collectorErrors: make(map[string]uint64),
+		watchdogEvents:  make(map[string]uint64),
+		panicEvents:     make(map[string]uint64),
+	}
+}
+
+// acquireRPC waits for a free slot to call libvirt and returns the function
+// releasing it, to be called as soon as the call returns.
+func (e *LibvirtExporter) acquireRPC() func() {
+	if e.config.RPCSlots == nil {
+		return func() {}
+	}
+
+	e.config.RPCSlots <- struct{}{}
+
+	return func() { <-e.config.RPCSlots }
+}
+
+// callLibvirt runs a libvirt call, retrying it once after a short delay if it
+// failed with an error which is likely to be transient, e.g. while libvirtd reloads.
+func (e *LibvirtExporter) callLibvirt(call func() error) error {
+	release := e.acquireRPC()
+	err := call()
+	release()
+
+	if err == nil || !isTransientError(err) {
+		return err
+	}
+
+	time.Sleep(transientErrorRetryDelay)
+
+	release = e.acquireRPC()
+	defer release()
+
+	return call()
+}
+
+// cpuUsagePercent records the CPU time of a domain and returns its CPU usage since the
+// previous call, normalized by the number of virtual CPUs. The second return value is
+// false when there is no usable previous sample.
+func (e *LibvirtExporter) cpuUsagePercent(uuid string, cpuTime uint64, nrVirtCPU uint) (float64, bool) {
+	now := time.Now()
+
+	e.cpuTimesMutex.Lock()
+	defer e.cpuTimesMutex.Unlock()
+
+	prev, found := e.cpuTimes[uuid]
+	e.cpuTimes[uuid] = cpuTimeSample{cpuTime: cpuTime, timestamp: now}
+
+	// The CPU time goes backwards when the domain is restarted
+	if !found || cpuTime < prev.cpuTime || nrVirtCPU == 0 {
+		return 0, false
+	}
+
+	elapsed := now.Sub(prev.timestamp)
+	if elapsed <= 0 {
+		return 0, false
+	}
+
+	return float64(cpuTime-prev.cpuTime) / float64(elapsed.Nanoseconds()) / float64(nrVirtCPU) * 100, true
+}
+
+// pruneCPUTimes forgets the CPU time of the domains which were not seen since the given time.
+func (e *LibvirtExporter) pruneCPUTimes(since time.Time) {
+	e.cpuTimesMutex.Lock()
+	defer e.cpuTimesMutex.Unlock()
+
+	for uuid, sample := range e.cpuTimes {
+		if sample.timestamp.Before(since) {
+			delete(e.cpuTimes, uuid)
+		}
+	}
+}
+
+// stateSince records the state of a domain and returns when it was first seen in
+// that state. The first time a domain is seen, that's now.
+func (e *LibvirtExporter) stateSince(uuid string, state libvirt.DomainState) time.Time {
+	now := time.Now()
+
+	e.statesMutex.Lock()
+	defer e.statesMutex.Unlock()
+
+	sample, found := e.states[uuid]
+	if !found || sample.state != state {
+		sample = stateSample{state: state, since: now}
+	}
+	sample.timestamp = now
+	e.states[uuid] = sample
+
+	return sample.since
+}
+
+// pruneStates forgets the state of the domains which were not seen since the given
+// time, so that a domain which reappears starts over.
+func (e *LibvirtExporter) pruneStates(since time.Time) {
+	e.statesMutex.Lock()
+	defer e.statesMutex.Unlock()
+
+	for uuid, sample := range e.states {
+		if sample.timestamp.Before(since) {
+			delete(e.states, uuid)
+		}
+	}
+}
+
+// balloonDeflateStuck records the balloon size of a domain and returns whether it
+// stayed above the target, without shrinking, over the last balloonHistoryLength
+// scrapes. The history starts over whenever the balloon reaches its target.
+func (e *LibvirtExporter) balloonDeflateStuck(uuid string, target uint64, actual uint64) bool {
+	e.balloonsMutex.Lock()
+	defer e.balloonsMutex.Unlock()
+
+	history := e.balloons[uuid]
+	history.timestamp = time.Now()
+	if actual <= target {
+		history.sizes = nil
+	} else {
+		history.sizes = append(history.sizes, actual)
+		if len(history.sizes) > balloonHistoryLength {
+			history.sizes = history.sizes[1:]
+		}
+	}
+	e.balloons[uuid] = history
+
+	return len(history.sizes) == balloonHistoryLength && history.sizes[len(history.sizes)-1] >= history.sizes[0]
+}
+
+// pruneBalloons forgets the balloon sizes of the domains which were not seen since
+// the given time.
+func (e *LibvirtExporter) pruneBalloons(since time.Time) {
+	e.balloonsMutex.Lock()
+	defer e.balloonsMutex.Unlock()
+
+	for uuid, history := range e.balloons {
+		if history.timestamp.Before(since) {
+			delete(e.balloons, uuid)
+		}
+	}
+}
+
+// domainConfigHash returns the hash of the persistent XML description of a domain,
+// reusing the one of the previous scrape when the description didn't change. This is
+// told by its maphash, which is much faster to compute than the FNV-1a hash but only
+// stable within the process, and doesn't need a copy of the description.
+func (e *LibvirtExporter) domainConfigHash(uuid string, xmlDesc string) uint64 {
+	var h maphash.Hash
+	h.SetSeed(e.configHashSeed)
+	h.WriteString(xmlDesc)
+	key := h.Sum64()
+
+	e.configHashesMutex.Lock()
+	defer e.configHashesMutex.Unlock()
+
+	cached, ok := e.configHashes[uuid]
+	if !ok || cached.key != key {
+		cached = configHash{key: key, hash: hashConfig(xmlDesc)}
+	}
+	cached.timestamp = time.Now()
+	e.configHashes[uuid] = cached
+
+	return cached.hash
+}
+
+// pruneConfigHashes forgets the hashes of the domains which were not seen since the
+// given time.
+func (e *LibvirtExporter) pruneConfigHashes(since time.Time) {
+	e.configHashesMutex.Lock()
+	defer e.configHashesMutex.Unlock()
+
+	for uuid, cached := range e.configHashes {
+		if cached.timestamp.Before(since) {
+			delete(e.configHashes, uuid)
+		}
+	}
+}
+
+// hashConfig returns the FNV-1a hash of an XML description, truncated to 53 bits
+// so that it's exactly represented by the float64 value of a metric.
+func hashConfig(xmlDesc string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(xmlDesc))
+	return h.Sum64() & (1<<53 - 1)
+}
+
+// Describe returns metadata for all Prometheus metrics that may be exported.
+// Every descriptor used by Collect has to be sent here, otherwise the registry
+// fails the whole scrape. The opposite is fine: the steal time and the QEMU
+// process metrics are described but never collected over a read-only connection.
+func (e *LibvirtExporter) Describe(ch chan<- *prometheus.Desc) {
+	// Status
+	ch <- e.libvirtUpDesc
+	ch <- e.libvirtScrapesInFlightDesc
+	ch <- e.libvirtScrapesTotalDesc
+	ch <- e.libvirtDomainsFailedDesc
+	ch <- e.libvirtDomainsActiveDesc
+	ch <- e.libvirtDomainsInactiveDesc
+	ch <- e.libvirtDomainsTruncatedDesc
+	ch <- e.libvirtCollectorErrorsDesc
+
+	if e.config.BackgroundInterval > 0 {
+		ch <- e.libvirtLastScrapeTimeDesc
+	}
+
+	// Connection
+	ch <- e.libvirtConnectionReconnectsDesc
+	ch <- e.libvirtConnectionConnectDurationDesc
+	ch <- e.libvirtConnectionReadOnlyDesc
+
+	if e.config.HealthCheckInterval > 0 {
+		ch <- e.libvirtConnectionHealthyDesc
+		ch <- e.libvirtConnectionLastHealthyDesc
+	}
+
+	ch <- e.libvirtConnectionFailuresDesc
+	ch <- e.libvirtRPCGetAllDomainStatsDurationDesc
+
+	// Node resources and their assignment to the domains
+	ch <- e.libvirtNodeMemoryDesc
+	ch <- e.libvirtNodeCPUsDesc
+	ch <- e.libvirtNodeDomainAssignedMemoryDesc
+	ch <- e.libvirtNodeDomainAssignedVcpusDesc
+	ch <- e.libvirtNodeDomainsByStateDesc
+	if e.config.Collectors.NodeCPUFreq && isLocalURI(e.uri) {
+		ch <- e.libvirtNodeCPUFrequencyDesc
+	}
+
+	// Node capabilities
+	if e.config.Collectors.NodeCaps {
+		ch <- e.libvirtNodeDomainCapsMaxVcpusDesc
+		ch <- e.libvirtNodeMachineTypeInfoDesc
+	}
+
+	// Node migrations
+	if e.config.Collectors.Migrations {
+		ch <- e.libvirtNodeActiveMigrationsDesc
+	}
+
+	// Domain info
+	if e.config.Collectors.Info {
+		ch <- e.libvirtDomainInfoMaxMemDesc
+		ch <- e.libvirtDomainInfoMemoryUsageDesc
+		ch <- e.libvirtDomainInfoNrVirtCPUDesc
+		ch <- e.libvirtDomainInfoCPUTimeDesc
+		ch <- e.libvirtDomainInfoCPUUserTimeDesc
+		ch <- e.libvirtDomainInfoCPUSystemTimeDesc
+		ch <- e.libvirtDomainInfoVirDomainState
+		ch <- e.libvirtDomainCPUUsagePercentDesc
+		ch <- e.libvirtDomainStateSinceDesc
+	}
+
+	if e.config.Collectors.StealTime {
+		ch <- e.libvirtDomainInfoCPUStealTimeDesc
+		ch <- e.libvirtDomainVcpuNumaNodeDesc
+	}
+
+	if e.config.Collectors.QemuProcess {
+		ch <- e.libvirtDomainQemuProcessRssDesc
+		ch <- e.libvirtDomainQemuProcessThreadsDesc
+	}
+
+	if e.config.Collectors.KVMDebugfs {
+		ch <- e.libvirtDomainVcpuHaltPollSuccessDesc
+		ch <- e.libvirtDomainVcpuHaltWakeupDesc
+	}
+
+	for _, command := range e.config.QMPCustomCommands {
+		for _, metric := range command.Metrics {
+			ch <- metric.desc
+		}
+	}
+
+	if e.config.Collectors.ConfigHash {
+		ch <- e.libvirtDomainConfigHashDesc
+	}
+
+	if e.config.Collectors.Memtune {
+		ch <- e.libvirtDomainMemtuneHardLimitDesc
+		ch <- e.libvirtDomainMemtuneSoftLimitDesc
+		ch <- e.libvirtDomainMemtuneSwapHardLimitDesc
+		ch <- e.libvirtDomainMemoryLockedDesc
+	}
+
+	if e.config.Collectors.Blkio {
+		ch <- e.libvirtDomainBlkioWeightDesc
+		ch <- e.libvirtDomainBlkioDeviceWeightDesc
+	}
+
+	if e.statsGroups()&libvirt.DOMAIN_STATS_DIRTYRATE != 0 {
+		ch <- e.libvirtDomainDirtyRateDesc
+	}
+
+	if e.config.Collectors.Events {
+		ch <- e.libvirtDomainWatchdogEventsDesc
+		ch <- e.libvirtDomainPanicEventsDesc
+	}
+
+	if len(e.config.MetadataLabels) > 0 {
+		ch <- e.libvirtDomainMetadataDesc
+	}
+
+	// Domain CPU model
+	ch <- e.libvirtDomainCPUModelInfoDesc
+	ch <- e.libvirtDomainCPUTopologyInfoDesc
+	ch <- e.libvirtDomainCPUTopologyVcpusDesc
+	ch <- e.libvirtDomainNestedVirtDesc
+
+	if e.config.Collectors.CPUFeatures {
+		ch <- e.libvirtDomainCPUFeatureDesc
+	}
+
+	// Domain graphical consoles
+	ch <- e.libvirtDomainGraphicsInfoDesc
+	ch <- e.libvirtDomainGraphicsPortDesc
+
+	// Domain host devices
+	ch <- e.libvirtDomainHostdevInfoDesc
+
+	// Domain title and description
+	ch <- e.libvirtDomainDescriptionInfoDesc
+
+	// Domain emulator
+	ch <- e.libvirtDomainEmulatorInfoDesc
+
+	// Domain guest agent
+	ch <- e.libvirtDomainAgentConnectedDesc
+
+	// Domain random number generators
+	ch <- e.libvirtDomainRNGInfoDesc
+
+	// Domain video devices
+	ch <- e.libvirtDomainVideoInfoDesc
+	ch <- e.libvirtDomainVideoVRAMBytesDesc
+
+	// Domain boot order
+	ch <- e.libvirtDomainBootOrderInfoDesc
+
+	// Domain NUMA memory placement
+	ch <- e.libvirtDomainNumatuneInfoDesc
+	ch <- e.libvirtDomainNumatuneMemnodeInfoDesc
+
+	// Domain hugepages
+	ch <- e.libvirtDomainHugepageBackingInfoDesc
+	ch <- e.libvirtDomainHugepagePageSizeDesc
+
+	// Domain TPM and secure boot
+	ch <- e.libvirtDomainTPMInfoDesc
+	ch <- e.libvirtDomainSecureBootEnabledDesc
+	ch <- e.libvirtDomainSEVEnabledDesc
+	ch <- e.libvirtDomainSEVInfoDesc
+
+	// Domain cache and memory bandwidth monitoring
+	ch <- e.libvirtDomainCacheOccupancyDesc
+	ch <- e.libvirtDomainMemoryBandwidthTotalDesc
+	ch <- e.libvirtDomainMemoryBandwidthLocalDesc
+
+	if e.config.LegacyMetrics {
+		ch <- e.libvirtLegacyDomainMemoryBandwidthTotalDesc
+		ch <- e.libvirtLegacyDomainMemoryBandwidthLocalDesc
+	}
+
+	// Domain block stats
+	if e.config.Collectors.Block {
+		ch <- e.libvirtDomainBlockRdBytesDesc
+		ch <- e.libvirtDomainBlockRdReqDesc
+		ch <- e.libvirtDomainBlockRdTotalTimesDesc
+		if e.config.LegacyMetrics {
+			ch <- e.libvirtLegacyDomainBlockRdTotalTimesDesc
+		}
+		ch <- e.libvirtDomainBlockWrBytesDesc
+		ch <- e.libvirtDomainBlockWrReqDesc
+		ch <- e.libvirtDomainBlockWrTotalTimesDesc
+		ch <- e.libvirtDomainBlockFlushReqDesc
+		ch <- e.libvirtDomainBlockFlushTotalTimesDesc
+		ch <- e.libvirtDomainBlockAllocationDesc
+		ch <- e.libvirtDomainBlockCapacityDesc
+		ch <- e.libvirtDomainBlockPhysicalSizeDesc
+		ch <- e.libvirtDomainBlockOvercommitDesc
+		ch <- e.libvirtDomainBlockBackingChainDepthDesc
+		ch <- e.libvirtDomainBlockDriverInfoDesc
+		ch <- e.libvirtDomainBlockInfoDesc
+		ch <- e.libvirtDomainBlockFlagsInfoDesc
+		ch <- e.libvirtDomainBlockTotalRequestsDesc
+		ch <- e.libvirtDomainBlockTotalBytesDesc
+		ch <- e.libvirtDomainBlockLogicalBlockSizeDesc
+		ch <- e.libvirtDomainBlockPhysicalBlockSizeDesc
+	}
+
+	// Domain block backing chains
+	if e.config.Collectors.Block && e.config.Collectors.BlockBacking {
+		ch <- e.libvirtDomainBlockBackingCapacityDesc
+	}
+
+	if e.config.Collectors.QMPBlockStats {
+		ch <- e.libvirtDomainBlockRdMergesDesc
+		ch <- e.libvirtDomainBlockWrMergesDesc
+		ch <- e.libvirtDomainBlockIdleTimeDesc
+		ch <- e.libvirtDomainBlockInvalidRdReqDesc
+		ch <- e.libvirtDomainBlockInvalidWrReqDesc
+		ch <- e.libvirtDomainBlockInvalidFlushReqDesc
+		ch <- e.libvirtDomainBlockRdLatencyDesc
+		ch <- e.libvirtDomainBlockWrLatencyDesc
+		ch <- e.libvirtDomainBlockFlushLatencyDesc
+	}
+
+	// Domain block jobs
+	if e.config.Collectors.BlockJobs {
+		ch <- e.libvirtDomainBlockJobCurDesc
+		ch <- e.libvirtDomainBlockJobEndDesc
+		ch <- e.libvirtDomainBlockJobTypeDesc
+	}
+
+	// Domain net interfaces stats
+	if e.config.Collectors.Interface {
+		ch <- e.libvirtDomainInterfaceRxBytesDesc
+		ch <- e.libvirtDomainInterfaceRxPacketsDesc
+		ch <- e.libvirtDomainInterfaceRxErrsDesc
+		ch <- e.libvirtDomainInterfaceRxDropDesc
+		ch <- e.libvirtDomainInterfaceTxBytesDesc
+		ch <- e.libvirtDomainInterfaceTxPacketsDesc
+		ch <- e.libvirtDomainInterfaceTxErrsDesc
+		ch <- e.libvirtDomainInterfaceTxDropDesc
+		ch <- e.libvirtDomainInterfaceLinkUpDesc
+		ch <- e.libvirtDomainInterfaceVhostuserDesc
+	}
+
+	// Domain memory stats
+	if e.config.Collectors.Memory {
+		ch <- e.libvirtDomainMemoryStatMajorfaultDesc
+		ch <- e.libvirtDomainMemoryStatMinorFaultDesc
+		ch <- e.libvirtDomainMemoryStatUnusedDesc
+		ch <- e.libvirtDomainMemoryStatAvailableDesc
+		ch <- e.libvirtDomainMemoryStatActualBaloonDesc
+		ch <- e.libvirtDomainMemoryStatRssDesc
+		ch <- e.libvirtDomainMemoryStatUsableDesc
+		ch <- e.libvirtDomainMemoryStatDiskCachesDesc
+		ch <- e.libvirtDomainMemoryStatSwapInDesc
+		ch <- e.libvirtDomainMemoryStatSwapOutDesc
+		ch <- e.libvirtDomainMemoryStatHugetlbPgAllocDesc
+		ch <- e.libvirtDomainMemoryStatHugetlbPgFailDesc
+		ch <- e.libvirtDomainMemoryStatUsedPercentDesc
+		ch <- e.libvirtDomainMemoryStatReportedDesc
+		ch <- e.libvirtDomainBalloonDeflateStuckDesc
+	}
+}
+
+// Collect scrapes Prometheus metrics from libvirt.
+func (e *LibvirtExporter) Collect(ch chan<- prometheus.Metric) {
+	inFlight := atomic.AddInt64(&e.scrapesInFlight, 1)
+	defer atomic.AddInt64(&e.scrapesInFlight, -1)
+
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtScrapesInFlightDesc,
+		prometheus.GaugeValue,
+		float64(inFlight))
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtScrapesTotalDesc,
+		prometheus.CounterValue,
+		float64(atomic.AddUint64(&e.scrapesTotal, 1)))
+
+	var err error
+	if e.config.BackgroundInterval > 0 {
+		err = e.collectFromSnapshot(ch)
+	} else {
+		err = e.collectFromLibvirtCached(ch)
+	}
+
+	e.collectConnectionStats(ch)
+	e.collectCollectorErrors(ch)
+
+	if err == nil {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtUpDesc,
+			prometheus.GaugeValue,
+			1.0,
+			redactURI(e.uri))
+	} else {
+		logLibvirtError(err)
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtUpDesc,
+			prometheus.GaugeValue,
+			0.0,
+			redactURI(e.uri))
+	}
+}
+
+// countCollectorError records an error of a collector which doesn't fail the domain.
+func (e *LibvirtExporter) countCollectorError(collector string) {
+	e.collectorErrorsMutex.Lock()
+	defer e.collectorErrorsMutex.Unlock()
+
+	e.collectorErrors[collector]++
+}
+
+// collectCollectorErrors reports the errors of the collectors.
+func (e *LibvirtExporter) collectCollectorErrors(ch chan<- prometheus.Metric) {
+	e.collectorErrorsMutex.Lock()
+	defer e.collectorErrorsMutex.Unlock()
+
+	for collector, errors := range e.collectorErrors {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtCollectorErrorsDesc,
+			prometheus.CounterValue,
+			float64(errors),
+			collector)
+	}
+}
+
+// collectFromLibvirtCached calls collectFromLibvirtRecovered, unless the cache is
+// enabled and another scrape is collecting the metrics or did so within the TTL, in
+// which case its metrics are served instead. Failed collections aren't reused.
+func (e *LibvirtExporter) collectFromLibvirtCached(ch chan<- prometheus.Metric) error {
+	if e.config.CacheTTL <= 0 {
+		if e.scrapeSlots != nil {
+			e.scrapeSlots <- struct{}{}
+			defer func() { <-e.scrapeSlots }()
+		}
+
+		return e.collectFromLibvirtRecovered(ch)
+	}
+
+	e.collectionMutex.Lock()
+	c := e.collection
+	if c == nil || c.expired(e.config.CacheTTL) {
+		c = &collection{done: make(chan struct{})}
+		e.collection = c
+		e.collectionMutex.Unlock()
+
+		e.fillCollection(c)
+	} else {
+		e.collectionMutex.Unlock()
+		<-c.done
+	}
+
+	for _, metric := range c.metrics {
+		ch <- metric
+	}
+
+	return c.err
+}
+
+// fillCollection collects the metrics from libvirt into the given collection,
+// waiting for a scrape slot if they are bounded, and marks it as done.
+func (e *LibvirtExporter) fillCollection(c *collection) {
+	if e.scrapeSlots != nil {
+		e.scrapeSlots <- struct{}{}
+		defer func() { <-e.scrapeSlots }()
+	}
+
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		c.err = e.collectFromLibvirtRecovered(metrics)
+		close(metrics)
+	}()
+
+	for metric := range metrics {
+		c.metrics = append(c.metrics, metric)
+	}
+
+	c.time = time.Now()
+	close(c.done)
+}
+
+// collectFromSnapshot serves the latest collection made in the background, with
+// the time at which it was made.
+func (e *LibvirtExporter) collectFromSnapshot(ch chan<- prometheus.Metric) error {
+	c := e.snapshot.Load()
+	if c == nil {
+		return errors.New("no metrics collected in the background yet")
+	}
+
+	for _, metric := range c.metrics {
+		ch <- metric
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtLastScrapeTimeDesc,
+		prometheus.GaugeValue,
+		float64(c.time.UnixNano())/1e9)
+
+	return c.err
+}
+
+// StartBackgroundCollection starts collecting the metrics from libvirt in the
+// background, right away and then at the configured interval, until
+// StopBackgroundCollection is called.
+func (e *LibvirtExporter) StartBackgroundCollection() {
+	e.backgroundMutex.Lock()
+	defer e.backgroundMutex.Unlock()
+
+	if e.config.BackgroundInterval <= 0 || e.stopBackground != nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	e.stopBackground = stop
+	e.backgroundDone = done
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(e.config.BackgroundInterval)
+		defer ticker.Stop()
+
+		for {
+			c := &collection{done: make(chan struct{})}
+			e.fillCollection(c)
+			e.snapshot.Store(c)
+
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// StopBackgroundCollection stops the collection started by StartBackgroundCollection.
+// A collection in progress is completed first, so that once it returns the connection
+// can be closed without the collection opening it again.
+func (e *LibvirtExporter) StopBackgroundCollection() {
+	e.backgroundMutex.Lock()
+	defer e.backgroundMutex.Unlock()
+
+	if e.stopBackground != nil {
+		close(e.stopBackground)
+		<-e.backgroundDone
+		e.stopBackground = nil
+		e.backgroundDone = nil
+	}
+}
+
+// StartHealthCheck starts checking the connection to libvirt in the background at
+// the configured interval, until StopHealthCheck is called, so that a dead connection
+// is replaced before the next scrape rather than found out by it.
+func (e *LibvirtExporter) StartHealthCheck() {
+	e.backgroundMutex.Lock()
+	defer e.backgroundMutex.Unlock()
+
+	if e.config.HealthCheckInterval <= 0 || e.stopHealthCheck != nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	e.stopHealthCheck = stop
+	e.healthCheckDone = done
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(e.config.HealthCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			e.checkHealth()
+
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// StopHealthCheck stops the health checks started by StartHealthCheck, waiting for
+// a check in progress, which may reconnect, to complete.
+func (e *LibvirtExporter) StopHealthCheck() {
+	e.backgroundMutex.Lock()
+	defer e.backgroundMutex.Unlock()
+
+	if e.stopHealthCheck != nil {
+		close(e.stopHealthCheck)
+		<-e.healthCheckDone
+		e.stopHealthCheck = nil
+		e.healthCheckDone = nil
+	}
+}
+
+// checkHealth asks libvirt for its version, which unlike IsAlive needs an answer
+// from libvirtd. A connection which doesn't answer is closed and opened again
+// right away, the scrapes using it keep their own reference. Other errors come from
+// libvirtd itself, which doesn't make the connection any better once replaced.
+func (e *LibvirtExporter) checkHealth() {
+	err := e.pingLibvirt()
+	if err != nil && isTransientError(err) {
+		logLibvirtError(err)
+		e.Close()
+		err = e.pingLibvirt()
+	}
+
+	e.connMutex.Lock()
+	defer e.connMutex.Unlock()
+
+	e.healthy = err == nil
+	if e.healthy {
+		e.lastHealthy = time.Now()
+	}
+}
+
+// pingLibvirt connects to libvirt if needed and makes a call on the connection.
+func (e *LibvirtExporter) pingLibvirt() error {
+	conn, _, err := e.Connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return e.callLibvirt(func() error {
+		_, err := conn.GetVersion()
+		return err
+	})
+}
+
+// collectFromLibvirtRecovered calls CollectFromLibvirt, turning a panic into an
+// error so that a single bad domain doesn't crash the exporter. The connection is
+// closed in that case, as its state is unknown.
+func (e *LibvirtExporter) collectFromLibvirtRecovered(ch chan<- prometheus.Metric) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic while collecting metrics from %s: %v\n%s", e.uri, r, debug.Stack())
+			e.Close()
+
+			err = fmt.Errorf("panic while collecting metrics: %v", r)
+		}
+	}()
+
+	return e.CollectFromLibvirt(ch)
+}
+
+// collectConnectionStats reports the statistics of the connection to libvirt.
+func (e *LibvirtExporter) collectConnectionStats(ch chan<- prometheus.Metric) {
+	e.connMutex.Lock()
+	defer e.connMutex.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtConnectionReconnectsDesc,
+		prometheus.CounterValue,
+		float64(e.reconnects))
+
+	if e.connectAttempted {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtConnectionConnectDurationDesc,
+			prometheus.GaugeValue,
+			e.connectDuration.Seconds())
+	}
+
+	if e.config.HealthCheckInterval > 0 {
+		var healthy float64
+		if e.healthy {
+			healthy = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtConnectionHealthyDesc,
+			prometheus.GaugeValue,
+			healthy)
+
+		if !e.lastHealthy.IsZero() {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtConnectionLastHealthyDesc,
+				prometheus.GaugeValue,
+				float64(e.lastHealthy.UnixNano())/1e9)
+		}
+	}
+
+	for reason, failures := range e.connectFailures {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtConnectionFailuresDesc,
+			prometheus.CounterValue,
+			float64(failures),
+			reason)
+	}
+}
+
+func (e *LibvirtExporter) connectLibvirtWithAuth(uri string) (ConnectHandle, error) {
+	if e.config.Login == "" || e.config.Password == "" {
+		return nil, fmt.Errorf("Empty username or password was provided. Not attempting to authenticate using SASL")
+	}
+
+	callback := func(creds []*libvirt.ConnectCredential) {
+		for _, cred := range creds {
+			switch cred.Type {
+			case libvirt.CRED_AUTHNAME:
+				cred.Result = e.config.Login
+				cred.ResultLen = len(cred.Result)
+
+			case libvirt.CRED_PASSPHRASE:
+				cred.Result = e.config.Password
+				cred.ResultLen = len(cred.Result)
+
+			case libvirt.CRED_USERNAME:
+			case libvirt.CRED_LANGUAGE:
+			case libvirt.CRED_CNONCE:
+			case libvirt.CRED_ECHOPROMPT:
+			case libvirt.CRED_NOECHOPROMPT:
+			case libvirt.CRED_REALM:
+			case libvirt.CRED_EXTERNAL:
+				// FIXME: not implemented
+				continue
+			}
+		}
+	}
+
+	auth := &libvirt.ConnectAuth{
+		CredType: []libvirt.ConnectCredentialType{
+			libvirt.CRED_AUTHNAME, libvirt.CRED_PASSPHRASE,
+		},
+		Callback: callback,
+	}
+
+	return e.dialer().NewConnectWithAuth(uri, auth, 0) // connect flag 0 means "read-write"
+}
+
+// ConnectHandle is the part of *libvirt.Connect used to collect the metrics, so that
+// they can also be collected from a fake hypervisor. The domains are listed with
+// their handles, which have to be freed. The calls made one domain at a time wait
+// for a slot from acquire, as do the single calls of the exporter.
+type ConnectHandle interface {
+	IsAlive() (bool, error)
+	Ref() error
+	Close() (int, error)
+	GetType() (string, error)
+	GetVersion() (uint32, error)
+	GetNodeInfo() (*libvirt.NodeInfo, error)
+	GetCapabilities() (string, error)
+	GetDomainCapabilities(emulatorbin string, arch string, machine string, virttype string, flags uint32) (string, error)
+	DomainEventWatchdogRegister(dom *libvirt.Domain, callback libvirt.DomainEventWatchdogCallback) (int, error)
+	DomainEventLifecycleRegister(dom *libvirt.Domain, callback libvirt.DomainEventLifecycleCallback) (int, error)
+	DomainEventDeregister(callbackID int) error
+	ListDomains(flags libvirt.ConnectListAllDomainsFlags) ([]DomainHandle, error)
+	GetDomainStats(statsTypes libvirt.DomainStatsTypes, flags libvirt.ConnectGetAllDomainStatsFlags) ([]DomainWithStats, error)
+	GetDomainStatsOneByOne(statsTypes libvirt.DomainStatsTypes, flags libvirt.ConnectGetAllDomainStatsFlags, acquire func() func()) ([]DomainWithStats, int, error)
+}
+
+// DomainWithStats holds the handle of a domain and its statistics.
+type DomainWithStats struct {
+	Domain DomainHandle
+	Stats  libvirt.DomainStats
+}
+
+// libvirtConnect is a connection opened with the libvirt library.
+type libvirtConnect struct {
+	*libvirt.Connect
+}
+
+// ListDomains lists the domains of the connection.
+func (c libvirtConnect) ListDomains(flags libvirt.ConnectListAllDomainsFlags) ([]DomainHandle, error) {
+	domains, err := c.ListAllDomains(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	handles := make([]DomainHandle, len(domains))
+	for i := range domains {
+		handles[i] = &domains[i]
+	}
+
+	return handles, nil
+}
+
+// GetDomainStats fetches the statistics of all domains with a single call.
+func (c libvirtConnect) GetDomainStats(statsTypes libvirt.DomainStatsTypes, flags libvirt.ConnectGetAllDomainStatsFlags) ([]DomainWithStats, error) {
+	stats, err := c.GetAllDomainStats([]*libvirt.Domain{}, statsTypes, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	return withDomainHandles(stats), nil
+}
+
+// GetDomainStatsOneByOne fetches the statistics of every domain with a separate call,
+// so that the domains which fail do not prevent the others from being reported.
+// It returns the statistics obtained and the number of domains that failed. Every
+// call waits for a slot from acquire, not to exceed the concurrent calls allowed.
+func (c libvirtConnect) GetDomainStatsOneByOne(statsTypes libvirt.DomainStatsTypes, flags libvirt.ConnectGetAllDomainStatsFlags, acquire func() func()) ([]DomainWithStats, int, error) {
+	release := acquire()
+	domains, err := c.ListAllDomains(0)
+	release()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		stats  = make([]libvirt.DomainStats, 0, len(domains))
+		failed int
+	)
+
+	for i := range domains {
+		release := acquire()
+		domainStats, err := c.GetAllDomainStats([]*libvirt.Domain{&domains[i]}, statsTypes, flags)
+		release()
+		if err != nil {
+			logLibvirtError(err)
+			failed++
+		} else {
+			stats = append(stats, domainStats...)
+		}
+
+		// The returned statistics hold their own reference to the domain
+		if err = domains[i].Free(); err != nil {
+			logLibvirtError(err)
+		}
+	}
+
+	return withDomainHandles(stats), failed, nil
+}
+
+// withDomainHandles pairs the statistics with the domains they hold.
+func withDomainHandles(stats []libvirt.DomainStats) []DomainWithStats {
+	domains := make([]DomainWithStats, len(stats))
+	for i, stat := range stats {
+		domains[i] = DomainWithStats{Domain: stat.Domain, Stats: stat}
+	}
+
+	return domains
+}
+
+// dialer opens the connections to libvirt: read-write without or with authentication,
+// or read-only.
+type dialer interface {
+	NewConnect(uri string) (ConnectHandle, error)
+	NewConnectWithAuth(uri string, auth *libvirt.ConnectAuth, flags libvirt.ConnectFlags) (ConnectHandle, error)
+	NewConnectReadOnly(uri string) (ConnectHandle, error)
+}
+
+// libvirtDialer opens the connections with the libvirt library.
+type libvirtDialer struct{}
+
+func (libvirtDialer) NewConnect(uri string) (ConnectHandle, error) {
+	conn, err := libvirt.NewConnect(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	return libvirtConnect{conn}, nil
+}
+
+func (libvirtDialer) NewConnectWithAuth(uri string, auth *libvirt.ConnectAuth, flags libvirt.ConnectFlags) (ConnectHandle, error) {
+	conn, err := libvirt.NewConnectWithAuth(uri, auth, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	return libvirtConnect{conn}, nil
+}
+
+func (libvirtDialer) NewConnectReadOnly(uri string) (ConnectHandle, error) {
+	conn, err := libvirt.NewConnectReadOnly(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	return libvirtConnect{conn}, nil
+}
+
+// dialer returns what opens the connections to libvirt, the libvirt library unless
+// replaced by a fake hypervisor.
+func (e *LibvirtExporter) dialer() dialer {
+	if e.config.dialer != nil {
+		return e.config.dialer
+	}
+
+	return libvirtDialer{}
+}
+
+// sysfsRoot returns where the sysfs of the host is mounted.
+func (e *LibvirtExporter) sysfsRoot() string {
+	if e.config.sysfsRoot != "" {
+		return e.config.sysfsRoot
+	}
+
+	return sysfsPath
+}
+
+// Connect returns a connection to libvirt and whether it is read-only. The connection
+// is kept open between scrapes and only re-established once it is no longer alive.
+// The caller has to Close() the returned connection when done with it.
+func (e *LibvirtExporter) Connect() (ConnectHandle, bool, error) {
+	e.connMutex.Lock()
+	defer e.connMutex.Unlock()
+
+	if e.conn != nil {
+		// The read-only connection is replaced once a domain needs the QEMU monitor
+		if alive, err := e.conn.IsAlive(); err == nil && alive && !(e.readOnlyFirst && e.readWriteNeeded) {
+			if err = e.conn.Ref(); err == nil {
+				return e.conn, e.readOnly, nil
+			}
+		}
+
+		// The connection is gone, drop it and open a new one
+		e.deregisterEventCallbacks()
+		if _, err := e.conn.Close(); err != nil {
+			logLibvirtError(err)
+		}
+
+		e.conn = nil
+	}
+
+	if e.connectAttempted {
+		e.reconnects++
+	}
+
+	// Never escalated with --libvirt.read-only
+	readOnlyFirst := e.config.ReadOnlyFirst && !e.config.ReadOnly && !e.readWriteNeeded
+
+	start := time.Now()
+	conn, readOnly, err := e.dial(readOnlyFirst)
+	e.connectDuration = time.Since(start)
+	e.connectAttempted = true
+
+	if err != nil {
+		reason := connectErrorReason(err)
+		e.connectFailures[reason]++
+
+		return nil, false, fmt.Errorf("failed to connect to %s (%s): %w", e.uri, reason, err)
+	}
+
+	// One reference is kept by the exporter, the other one is handed to the caller
+	if err = conn.Ref(); err != nil {
+		conn.Close()
+
+		return nil, false, err
+	}
+
+	e.conn = conn
+	e.readOnly = readOnly
+	e.readOnlyFirst = readOnly && readOnlyFirst
+	e.qemuMonitor = hasQemuMonitor(conn)
+	e.nodeInfo = nil
+
+	// The counters start over with the new callbacks, as documented in their help
+	if e.config.Collectors.Events {
+		e.resetEvents()
+		e.registerEventCallbacks(conn)
+	}
+
+	return conn, readOnly, nil
+}
+
+// registerEventCallbacks subscribes to the watchdog and panic events of all
+// domains on a new connection. The callbacks are run by the libvirt event loop,
+// which has to be started with RunEventLoop before the connection is opened.
+// Must be called with connMutex held.
+func (e *LibvirtExporter) registerEventCallbacks(conn ConnectHandle) {
+	id, err := conn.DomainEventWatchdogRegister(nil, e.handleWatchdogEvent)
+	if err != nil {
+		logLibvirtError(err)
+	} else {
+		e.eventCallbacks = append(e.eventCallbacks, id)
+	}
+
+	id, err = conn.DomainEventLifecycleRegister(nil, e.handleLifecycleEvent)
+	if err != nil {
+		logLibvirtError(err)
+	} else {
+		e.eventCallbacks = append(e.eventCallbacks, id)
+	}
+}
+
+// deregisterEventCallbacks unsubscribes from the events of the current connection
+// before it is closed. Must be called with connMutex held.
+func (e *LibvirtExporter) deregisterEventCallbacks() {
+	for _, id := range e.eventCallbacks {
+		if err := e.conn.DomainEventDeregister(id); err != nil {
+			logLibvirtError(err)
+		}
+	}
+
+	e.eventCallbacks = nil
+}
+
+// handleWatchdogEvent counts a firing of the watchdog device of a domain.
+func (e *LibvirtExporter) handleWatchdogEvent(c *libvirt.Connect, d *libvirt.Domain, event *libvirt.DomainEventWatchdog) {
+	e.countDomainEvent(e.watchdogEvents, d)
+}
+
+// handleLifecycleEvent counts the crashes of a domain caused by a guest panic.
+func (e *LibvirtExporter) handleLifecycleEvent(c *libvirt.Connect, d *libvirt.Domain, event *libvirt.DomainEventLifecycle) {
+	if event.Event == libvirt.DOMAIN_EVENT_CRASHED && event.Detail == int(libvirt.DOMAIN_EVENT_CRASHED_PANICKED) {
+		e.countDomainEvent(e.panicEvents, d)
+	}
+}
+
+// countDomainEvent increments the counter of the domain in the given events map.
+// It runs on the event loop, which mustn't wait for libvirt calls, so the excluded
+// and unselected domains are only filtered out when the events are collected.
+func (e *LibvirtExporter) countDomainEvent(events map[string]uint64, d DomainHandle) {
+	domainName, err := d.GetName()
+	if err != nil {
+		logLibvirtError(err)
+		return
+	}
+
+	e.eventsMutex.Lock()
+	defer e.eventsMutex.Unlock()
+
+	events[domainName]++
+}
+
+// resetEvents forgets the events received, when the callbacks are registered on a
+// new connection. The maps are emptied rather than replaced, as the callbacks
+// still running hold them.
+func (e *LibvirtExporter) resetEvents() {
+	e.eventsMutex.Lock()
+	defer e.eventsMutex.Unlock()
+
+	for _, events := range []map[string]uint64{e.watchdogEvents, e.panicEvents} {
+		for name := range events {
+			delete(events, name)
+		}
+	}
+}
+
+// pruneEvents forgets the events of the domains which no longer exist, given all
+// the domains of the host.
+func (e *LibvirtExporter) pruneEvents(domains []DomainWithStats) {
+	names := make(map[string]bool, len(domains))
+	for _, domain := range domains {
+		name, err := domain.Domain.GetName()
+		if err != nil {
+			// Don't forget the events of a domain only because its name is unknown
+			logLibvirtError(err)
+			return
+		}
+
+		names[name] = true
+	}
+
+	e.eventsMutex.Lock()
+	defer e.eventsMutex.Unlock()
+
+	for _, events := range []map[string]uint64{e.watchdogEvents, e.panicEvents} {
+		for name := range events {
+			if !names[name] {
+				delete(events, name)
+			}
+		}
+	}
+}
+
+// collectEventStats emits the number of events received for every domain, given
+// all the domains of the host, except for the domains excluded from the metrics
+// or not selected. The domains already filtered are looked up in reported.
+func (e *LibvirtExporter) collectEventStats(ch chan<- prometheus.Metric, domains []DomainWithStats, reported map[DomainHandle]bool) {
+	// Copied, not to block the event callbacks during the libvirt calls below
+	e.eventsMutex.Lock()
+	watchdogEvents := make(map[string]uint64, len(e.watchdogEvents))
+	for domainName, count := range e.watchdogEvents {
+		watchdogEvents[domainName] = count
+	}
+	panicEvents := make(map[string]uint64, len(e.panicEvents))
+	for domainName, count := range e.panicEvents {
+		panicEvents[domainName] = count
+	}
+	e.eventsMutex.Unlock()
+
+	for _, domain := range domains {
+		domainName, err := domain.Domain.GetName()
+		if err != nil {
+			logLibvirtError(err)
+			continue
+		}
+
+		watchdogCount, watchdogFired := watchdogEvents[domainName]
+		panicCount, panicked := panicEvents[domainName]
+		if !watchdogFired && !panicked {
+			continue
+		}
+
+		selected, filtered := reported[domain.Domain]
+		if !filtered {
+			selected = e.domainAllowed(domain.Domain) && e.domainSelected(domain.Domain)
+		}
+
+		if !selected {
+			continue
+		}
+
+		if watchdogFired {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainWatchdogEventsDesc,
+				prometheus.CounterValue,
+				float64(watchdogCount),
+				domainName)
+		}
+
+		if panicked {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtDomainPanicEventsDesc,
+				prometheus.CounterValue,
+				float64(panicCount),
+				domainName)
+		}
+	}
+}
+
+// RunEventLoop registers the default libvirt event loop implementation and runs
+// it in the background for the lifetime of the process. It must be called before
+// any connection is opened, as only the connections opened afterwards deliver
+// events.
+func RunEventLoop() error {
+	if err := libvirt.EventRegisterDefaultImpl(); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			if err := libvirt.EventRunDefaultImpl(); err != nil {
+				logLibvirtError(err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// hasQemuMonitor returns whether the hypervisor behind the connection is QEMU/KVM,
+// the only one supporting the QEMU monitor passthrough used for the steal time.
+func hasQemuMonitor(conn ConnectHandle) bool {
+	hypervisor, err := conn.GetType()
+	if err != nil {
+		// Don't rule out the QEMU monitor because of a transient error
+		logLibvirtError(err)
+
+		return true
+	}
+
+	return hypervisor == "QEMU"
+}
+
+// qemuMonitorAvailable returns whether the QEMU monitor passthrough can be used
+// on the current connection.
+func (e *LibvirtExporter) qemuMonitorAvailable() bool {
+	e.connMutex.Lock()
+	defer e.connMutex.Unlock()
+
+	return e.qemuMonitor
+}
+
+// qemuMonitorUsable returns whether the QEMU monitor passthrough can be used, which
+// also requires a read-write connection.
+func (e *LibvirtExporter) qemuMonitorUsable() bool {
+	e.connMutex.Lock()
+	defer e.connMutex.Unlock()
+
+	return e.qemuMonitor && !e.readOnly
+}
+
+// qemuMonitorAllowed returns whether commands may be sent to the QEMU monitor of the
+// domain, which --collector.steal-time-domains restricts to the matching domains.
+func (e *LibvirtExporter) qemuMonitorAllowed(domainName string) bool {
+	return e.config.QemuMonitorDomains == nil || e.config.QemuMonitorDomains.MatchString(domainName)
+}
+
+// handleQemuMonitorError logs an error of a call through the QEMU monitor passthrough,
+// and stops using it if the error means that the connection driver doesn't support it.
+func (e *LibvirtExporter) handleQemuMonitorError(err error) {
+	logLibvirtError(err)
+
+	if isUnsupportedError(err) {
+		log.Printf("QEMU monitor passthrough is not supported by %s, not collecting the metrics relying on it\n", e.uri)
+		e.disableQemuMonitor()
+	}
+}
+
+// disableQemuMonitor stops using the QEMU monitor passthrough until the next reconnection.
+func (e *LibvirtExporter) disableQemuMonitor() {
+	e.connMutex.Lock()
+	defer e.connMutex.Unlock()
+
+	e.qemuMonitor = false
+}
+
+// isUnsupportedError returns whether the error means that the connection driver
+// doesn't support the requested call.
+func isUnsupportedError(err error) bool {
+	libvirtErr, ok := err.(libvirt.Error)
+
+	return ok && (libvirtErr.Code == libvirt.ERR_NO_SUPPORT || libvirtErr.Code == libvirt.ERR_OPERATION_UNSUPPORTED)
+}
+
+// transientErrorRetryDelay is how long to wait before retrying a call which
+// failed with a transient error.
+const transientErrorRetryDelay = 100 * time.Millisecond
+
+// isTransientError returns whether the error may go away when the call is retried.
+// Errors about the state of the domain, such as ERR_OPERATION_INVALID when it
+// isn't running, aren't.
+func isTransientError(err error) bool {
+	libvirtErr, ok := err.(libvirt.Error)
+	if !ok {
+		return false
+	}
+
+	switch libvirtErr.Code {
+	case libvirt.ERR_SYSTEM_ERROR, libvirt.ERR_RPC, libvirt.ERR_OPERATION_TIMEOUT:
+		return true
+	default:
+		return false
+	}
+}
+
+// needsQemuMonitor returns whether a collector relies on the QEMU monitor passthrough,
+// which requires a read-write connection.
+func (e *LibvirtExporter) needsQemuMonitor() bool {
+	collectors := e.config.Collectors
+
+	return collectors.StealTime || collectors.QemuProcess || collectors.KVMDebugfs ||
+		collectors.QMPBlockStats || len(e.config.QMPCustomCommands) > 0
+}
+
+// checkReadWriteNeeded makes the next scrape replace the read-only connection opened by
+// --libvirt.read-only-first with a read-write one, if the QEMU monitor would be used for
+// the running domain. Only the domains it would be used for, on a QEMU host, count.
+func (e *LibvirtExporter) checkReadWriteNeeded(domain DomainHandle) {
+	if !e.needsQemuMonitor() {
+		return
+	}
+
+	e.connMutex.Lock()
+	check := e.readOnlyFirst && !e.readWriteNeeded && e.qemuMonitor
+	e.connMutex.Unlock()
+
+	if !check {
+		return
+	}
+
+	domainName, err := domain.GetName()
+	if err != nil || !e.qemuMonitorAllowed(domainName) {
+		return
+	}
+
+	log.Printf("The domain %s needs the QEMU monitor, reconnecting to %s read-write at the next scrape\n", domainName, e.uri)
+
+	e.connMutex.Lock()
+	e.readWriteNeeded = true
+	e.connMutex.Unlock()
+}
+
+// dial opens a new connection to libvirt and returns whether it is read-only. With
+// readOnlyFirst, a read-only connection is tried first, as it doesn't authenticate.
+// When every attempt fails, the error of the first one is returned, the fallbacks
+// often failing for another reason than the actual cause, e.g. a TLS failure.
+func (e *LibvirtExporter) dial(readOnlyFirst bool) (ConnectHandle, bool, error) {
+	uri := e.uri
+	if e.config.TLSInsecure {
+		var err error
+		if uri, err = tlsNoVerifyURI(uri); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if e.config.ReadOnly {
+		conn, err := e.dialer().NewConnectReadOnly(uri)
+
+		return conn, true, err
+	}
+
+	var firstErr error
+
+	// A read-only connection doesn't authenticate, which is enough until a domain
+	// needs the QEMU monitor
+	if readOnlyFirst {
+		conn, err := e.dialer().NewConnectReadOnly(uri)
+		if err == nil {
+			return conn, true, nil
+		}
+		firstErr = err
+	}
+
+	// First, try to connect without authentication, and with the full access
+	conn, err := e.dialer().NewConnect(uri)
+	if err == nil {
+		return conn, false, nil
+	}
+	if firstErr == nil {
+		firstErr = err
+	}
+
+	// Then, if the connection has failed, we try accessing libvirt with the authentication
+	if conn, err = e.connectLibvirtWithAuth(uri); err == nil {
+		return conn, false, nil
+	}
+
+	// Then, if the authenticated connection failed we attempt to connect using readonly
+	if conn, err = e.dialer().NewConnectReadOnly(uri); err == nil {
+		return conn, true, nil
+	}
+
+	return nil, true, firstErr
+}
+
+// isLocalURI returns whether the libvirt URI is the one of a hypervisor running on the
+// host of the exporter, i.e. without a host name.
+func isLocalURI(uri string) bool {
+	parsed, err := url.Parse(uri)
+
+	return err == nil && parsed.Host == ""
+}
+
+// tlsNoVerifyURI returns the URI with the verification of the certificate of
+// libvirtd disabled if it uses the TLS transport, the default one for remote URIs.
+func tlsNoVerifyURI(uri string) (string, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+
+	if parsed.Host == "" || (strings.Contains(parsed.Scheme, "+") && !strings.HasSuffix(parsed.Scheme, "+tls")) {
+		return uri, nil
+	}
+
+	query := parsed.Query()
+	query.Set("no_verify", "1")
+	parsed.RawQuery = query.Encode()
+
+	return parsed.String(), nil
+}
+
+// connectErrorReason classifies an error returned when connecting to libvirt,
+// to tell certificate issues apart from authentication and other failures.
+func connectErrorReason(err error) string {
+	libvirtErr, ok := err.(libvirt.Error)
+	if !ok {
+		return "connect"
+	}
+
+	switch libvirtErr.Code {
+	case libvirt.ERR_GNUTLS_ERROR:
+		return "tls"
+	case libvirt.ERR_AUTH_FAILED, libvirt.ERR_AUTH_CANCELLED, libvirt.ERR_AUTH_UNAVAILABLE:
+		return "auth"
+	}
+
+	// Certificate validation failures are reported as system or RPC errors
+	message := strings.ToLower(libvirtErr.Message)
+	if strings.Contains(message, "certificate") || strings.Contains(message, "tls") {
+		return "tls"
+	}
+
+	return "connect"
+}
+
+// Close closes the connection kept open between scrapes.
+func (e *LibvirtExporter) Close() {
+	e.connMutex.Lock()
+	defer e.connMutex.Unlock()
+
+	if e.conn == nil {
+		return
+	}
+
+	e.deregisterEventCallbacks()
+	if _, err := e.conn.Close(); err != nil {
+		logLibvirtError(err)
+	}
+
+	e.conn = nil
+}
+
+// CollectFromLibvirt obtains Prometheus metrics from all domains in a
+// libvirt setup.
+func (e *LibvirtExporter) CollectFromLibvirt(ch chan<- prometheus.Metric) error {
+	scrapeStart := time.Now()
+
+	conn, readOnly, err := e.Connect()
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	var readOnlyValue float64
+	if readOnly {
+		readOnlyValue = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtConnectionReadOnlyDesc,
+		prometheus.GaugeValue,
+		readOnlyValue)
+
+	if e.config.Collectors.NodeCaps {
+		if err = e.collectNodeCaps(ch, conn); err != nil {
+			logLibvirtError(err)
+		}
+	}
+
+	// The sysfs is the one of the host running the exporter, so it's only read for the local
+	// hypervisors, not to report it with every remote target
+	if e.config.Collectors.NodeCPUFreq && isLocalURI(e.uri) {
+		if err = e.CollectNodeCPUFrequencies(ch, e.sysfsRoot()); err != nil {
+			log.Printf("Error fetching the frequency of the host CPUs: %v\n", err)
+			e.countCollectorError("node_cpufreq")
+		}
+	}
+
+	// The statistics are requested without CONNECT_GET_ALL_DOMAINS_STATS_ENFORCE_STATS,
+	// so unsupported groups are silently skipped. However, a single domain in a bad
+	// state still fails the bulk call, in which case we query the domains one by one.
+	var failedDomains int
+
+	release := e.acquireRPC()
+	callStart := time.Now()
+	stats, err := conn.GetDomainStats(e.statsGroups(), e.statsFlags())
+	callDuration := time.Since(callStart)
+	release()
+
+	// The best indicator of the load of libvirtd, as this call dominates the scrape
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtRPCGetAllDomainStatsDurationDesc,
+		prometheus.GaugeValue,
+		callDuration.Seconds())
+	if err != nil {
+		logLibvirtError(err)
+
+		if stats, failedDomains, err = conn.GetDomainStatsOneByOne(e.statsGroups(), e.statsFlags(), e.acquireRPC); err != nil {
+			return err
+		}
+	}
+
+	// Freed even if collecting a domain panics, not to leak them
+	defer func() {
+		for _, stat := range stats {
+			if err := stat.Domain.Free(); err != nil {
+				logLibvirtError(err)
+			}
+		}
+	}()
+
+	// Without any CONNECT_GET_ALL_DOMAINS_STATS_* filter flags the statistics
+	// cover both active and inactive domains, so we can count them here.
+	var activeDomains, inactiveDomains int
+
+	// Resources assigned to the active domains, for the overcommit ratios
+	var assignedMemory, assignedVcpus uint64
+
+	// Active migrations, by direction
+	migrations := map[string]int{"in": 0, "out": 0}
+
+	// Domains in each state, all states being reported
+	domainsByState := make(map[libvirt.DomainState]int, len(domainStateNames))
+
+	// Whether the domains filtered below are reported, reused for their events
+	reported := make(map[DomainHandle]bool)
+
+	// Past the cap, the domains are still counted from their statistics, but only
+	// the first ones are collected, the others are freed with the rest
+	collected := len(stats)
+	if maxDomains := e.config.MaxDomains; maxDomains > 0 && len(stats) > maxDomains {
+		if _, ok := errorLogLimiter.allow("max-domains "+e.uri, time.Now()); ok {
+			log.Printf("Found %d domains on %s, only collecting the first %d as set by --collector.max-domains\n", len(stats), redactURI(e.uri), maxDomains)
+		}
+		atomic.AddUint64(&e.domainsTruncated, uint64(len(stats)-maxDomains))
+		collected = maxDomains
+	}
+
+	for i, domain := range stats {
+		stat := domain.Stats
+		inactive := stat.State != nil && stat.State.StateSet && stat.State.State == libvirt.DOMAIN_SHUTOFF
+
+		if stat.State != nil && stat.State.StateSet {
+			domainsByState[stat.State.State]++
+		}
+
+		if inactive {
+			inactiveDomains++
+
+			if !e.config.Collectors.IncludeInactive {
+				continue
+			}
+		} else {
+			activeDomains++
+
+			assignedMemory += e.domainMaxMemory(domain.Domain, stat)
+
+			for _, vcpu := range stat.Vcpu {
+				if vcpu.StateSet && vcpu.State != libvirt.VCPU_OFFLINE {
+					assignedVcpus++
+				}
+			}
+
+			// One more call per domain, only made for the domains collected
+			if e.config.Collectors.Migrations && i < collected {
+				if direction, ok := e.domainMigration(domain.Domain); ok {
+					migrations[direction]++
+				}
+			}
+		}
+
+		// Still counted above, but none of their metrics are exported
+		if i >= collected {
+			continue
+		}
+
+		reported[domain.Domain] = e.domainAllowed(domain.Domain) && e.domainSelected(domain.Domain)
+		if !reported[domain.Domain] {
+			continue
+		}
+
+		if err = e.CollectDomain(ch, domain.Domain, stat); err != nil {
+			logLibvirtError(err)
+			failedDomains++
+
+			continue
+		}
+
+		if (e.config.Collectors.StealTime || e.config.Collectors.QemuProcess || e.config.Collectors.KVMDebugfs) && !inactive && !readOnly && e.qemuMonitorAvailable() {
+			if err = e.collectDomainQemu(ch, domain.Domain); err != nil {
+				e.handleQemuMonitorError(err)
+			}
+		}
+
+		if readOnly && stat.State != nil && stat.State.State == libvirt.DOMAIN_RUNNING {
+			e.checkReadWriteNeeded(domain.Domain)
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainsFailedDesc,
+		prometheus.GaugeValue,
+		float64(failedDomains))
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainsActiveDesc,
+		prometheus.GaugeValue,
+		float64(activeDomains))
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainsInactiveDesc,
+		prometheus.GaugeValue,
+		float64(inactiveDomains))
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtDomainsTruncatedDesc,
+		prometheus.CounterValue,
+		float64(atomic.LoadUint64(&e.domainsTruncated)))
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtNodeDomainAssignedMemoryDesc,
+		prometheus.GaugeValue,
+		float64(assignedMemory))
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtNodeDomainAssignedVcpusDesc,
+		prometheus.GaugeValue,
+		float64(assignedVcpus))
+
+	for state, name := range domainStateNames {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtNodeDomainsByStateDesc,
+			prometheus.GaugeValue,
+			float64(domainsByState[state]),
+			name)
+	}
+
+	if e.config.Collectors.Migrations {
+		for direction, count := range migrations {
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtNodeActiveMigrationsDesc,
+				prometheus.GaugeValue,
+				float64(count),
+				direction)
+		}
+	}
+
+	if nodeInfo, err := e.getNodeInfo(conn); err != nil {
+		logLibvirtError(err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtNodeMemoryDesc,
+			prometheus.GaugeValue,
+			float64(nodeInfo.Memory)*1024)
+		ch <- prometheus.MustNewConstMetric(
+			e.libvirtNodeCPUsDesc,
+			prometheus.GaugeValue,
+			float64(nodeInfo.Cpus))
+	}
+
+	e.pruneCPUTimes(scrapeStart)
+	e.pruneStates(scrapeStart)
+	e.pruneBalloons(scrapeStart)
+	e.pruneConfigHashes(scrapeStart)
+
+	if e.config.Collectors.Events {
+		e.pruneEvents(stats)
+		e.collectEventStats(ch, stats, reported)
+	}
+
+	return nil
+}
+
+// domainMaxMemory returns the maximum memory of a domain in bytes, from its balloon
+// statistics or, when the balloon group isn't requested, from its information.
+func (e *LibvirtExporter) domainMaxMemory(domain DomainHandle, stat libvirt.DomainStats) uint64 {
+	if stat.Balloon != nil && stat.Balloon.MaximumSet {
+		return stat.Balloon.Maximum * 1024
+	}
+
+	var info *libvirt.DomainInfo
+	err := e.callLibvirt(func() (err error) {
+		info, err = domain.GetInfo()
+		return err
+	})
+	if err != nil {
+		logLibvirtError(err)
+
+		return 0
+	}
+
+	return info.MaxMem * 1024
+}
+
+// getNodeInfo returns the memory and CPUs of the host. They hardly ever change, so
+// they are only fetched again with a new connection.
+func (e *LibvirtExporter) getNodeInfo(conn ConnectHandle) (*libvirt.NodeInfo, error) {
+	e.connMutex.Lock()
+	nodeInfo := e.nodeInfo
+	e.connMutex.Unlock()
+
+	if nodeInfo != nil {
+		return nodeInfo, nil
+	}
+
+	err := e.callLibvirt(func() (err error) {
+		nodeInfo, err = conn.GetNodeInfo()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	e.connMutex.Lock()
+	e.nodeInfo = nodeInfo
+	e.connMutex.Unlock()
+
+	return nodeInfo, nil
+}
+
+// domainStateNames are the names of the domain states, as virsh shows them.
+var domainStateNames = map[libvirt.DomainState]string{
+	libvirt.DOMAIN_NOSTATE:     "nostate",
+	libvirt.DOMAIN_RUNNING:     "running",
+	libvirt.DOMAIN_BLOCKED:     "blocked",
+	libvirt.DOMAIN_PAUSED:      "paused",
+	libvirt.DOMAIN_SHUTDOWN:    "shutdown",
+	libvirt.DOMAIN_SHUTOFF:     "shutoff",
+	libvirt.DOMAIN_CRASHED:     "crashed",
+	libvirt.DOMAIN_PMSUSPENDED: "pmsuspended",
+}
+
+// domainAllowed returns whether the metrics of the domain may be exported, according
+// to the UUID allowlist and denylist. The denylist wins over the allowlist. Domains
+// whose UUID can't be read are excluded when any of the lists is set.
+func (e *LibvirtExporter) domainAllowed(domain DomainHandle) bool {
+	if len(e.config.DomainUUIDAllowlist) == 0 && len(e.config.DomainUUIDDenylist) == 0 {
+		return true
+	}
+
+	domainUUID, err := domain.GetUUIDString()
+	if err != nil {
+		logLibvirtError(err)
+
+		return false
+	}
+
+	domainUUID = strings.ToLower(domainUUID)
+	if e.config.DomainUUIDDenylist[domainUUID] {
+		return false
+	}
+
+	return len(e.config.DomainUUIDAllowlist) == 0 || e.config.DomainUUIDAllowlist[domainUUID]
+}
+
+// domainSelected returns whether the metadata of the domain matches the metadata
+// selector, if any. Domains whose metadata can't be read aren't selected, and the
+// error is counted so that losing them all, e.g. to a connection error, shows.
+func (e *LibvirtExporter) domainSelected(domain DomainHandle) bool {
+	if e.config.MetadataSelector == nil {
+		return true
+	}
+
+	var selected bool
+	err := e.callLibvirt(func() (err error) {
+		selected, err = e.config.MetadataSelector.Matches(domain)
+		return err
+	})
+	if err != nil {
+		logLibvirtError(err)
+		e.countCollectorError("metadata_selector")
+
+		return false
+	}
+
+	return selected
+}
+
+// domainMigration returns the direction, in or out, of the migration of the domain,
+// if it is being migrated. Errors are counted, not to fail the whole scrape.
+func (e *LibvirtExporter) domainMigration(domain DomainHandle) (string, bool) {
+	var job *libvirt.DomainJobInfo
+	err := e.callLibvirt(func() (err error) {
+		job, err = domain.GetJobStats(0)
+		return err
+	})
+	if err != nil {
+		logLibvirtError(err)
+		e.countCollectorError("migrations")
+
+		return "", false
+	}
+
+	return migrationDirection(job)
+}
+
+// migrationDirection returns the direction of the migration of an active job. The
+// operation of the jobs is only known since libvirt 3.3, older versions never
+// report a migration.
+func migrationDirection(job *libvirt.DomainJobInfo) (string, bool) {
+	if job.Type != libvirt.DOMAIN_JOB_BOUNDED && job.Type != libvirt.DOMAIN_JOB_UNBOUNDED {
+		return "", false
+	}
+
+	if !job.OperationSet {
+		return "", false
+	}
+
+	switch job.Operation {
+	case libvirt.DOMAIN_JOB_OPERATION_MIGRATION_IN:
+		return "in", true
+	case libvirt.DOMAIN_JOB_OPERATION_MIGRATION_OUT:
+		return "out", true
+	default:
+		return "", false
+	}
+}
+
+// collectNodeCaps reports the machine types supported by the host and the maximum
+// number of vCPUs of a domain using its default emulator and machine type.
+func (e *LibvirtExporter) collectNodeCaps(ch chan<- prometheus.Metric, conn ConnectHandle) error {
+	var domainCapsXML string
+	err := e.callLibvirt(func() (err error) {
+		domainCapsXML, err = conn.GetDomainCapabilities("", "", "", "", 0)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var domainCaps libvirt_schema.DomainCapabilities
+	if err = xml.Unmarshal([]byte(domainCapsXML), &domainCaps); err != nil {
+		return err
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		e.libvirtNodeDomainCapsMaxVcpusDesc,
+		prometheus.GaugeValue,
+		float64(domainCaps.VCPU.Max),
+		domainCaps.Arch,
+		domainCaps.Machine,
+		domainCaps.Domain)
+
+	var capsXML string
+	err = e.callLibvirt(func() (err error) {
+		capsXML, err = conn.GetCapabilities()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var caps libvirt_schema.Capabilities
+	if err = xml.Unmarshal([]byte(capsXML), &caps); err != nil {
+		return err
+	}
+
+	// The same architecture can be listed for several OS types
+	seen := make(map[[2]string]bool)
+	for _, guest := range caps.Guests {
+		for _, machine := range guest.Arch.Machines {
+			key := [2]string{guest.Arch.Name, machine.Name}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			ch <- prometheus.MustNewConstMetric(
+				e.libvirtNodeMachineTypeInfoDesc,
+				prometheus.GaugeValue,
+				1,
+				guest.Arch.Name,
+				machine.Name)
+		}
+	}
+
+	return nil
+}
+
+// statsGroups returns the statistics groups to request for every domain, without
+// those only used by disabled collectors.
+func (e *LibvirtExporter) statsGroups() libvirt.DomainStatsTypes {
+	groups := e.config.StatsGroups
+	if groups == 0 {
+		groups = domainStatsTypes
+	}
+
+	collectors := e.config.Collectors
+	if !collectors.Block && !collectors.BlockJobs {
+		groups &^= libvirt.DOMAIN_STATS_BLOCK
+	}
+	if !collectors.Interface {
+		groups &^= libvirt.DOMAIN_STATS_INTERFACE
+	}
+	if !collectors.Memory {
+		groups &^= libvirt.DOMAIN_STATS_BALLOON
+	}
+	if !collectors.Info {
+		groups &^= libvirt.DOMAIN_STATS_CPU_TOTAL
+	}
+
+	return groups
+}
+
+// statsFlags returns the flags of the statistics requests. With the block-backing
+// collector, the images of the backing chains are reported as well.
+func (e *LibvirtExporter) statsFlags() libvirt.ConnectGetAllDomainStatsFlags {
+	if e.config.Collectors.Block && e.config.Collectors.BlockBacking {
+		return libvirt.CONNECT_GET_ALL_DOMAINS_STATS_BACKING
+	}
+
+	return 0
+}
+
+// TargetsManager keeps an exporter registered for every libvirt URI listed in a
+// targets file. The metrics of each exporter are labelled with its host.
+//
+// The registry collects the exporters concurrently, each one through its own
+// connection, so a slow or unreachable host doesn't hold up the others. The
+// number of targets scraped at the same time can be bounded.
+type TargetsManager struct {
+	path        string
+	config      Config
+	registerer  prometheus.Registerer
+	scrapeSlots chan struct{}
+
+	exporters map[string]*LibvirtExporter
+	mutex     sync.Mutex
+}
+
+// NewTargetsManager creates a manager for the targets listed in the given file.
+// At most maxConcurrentScrapes targets are scraped at the same time, 0 meaning no limit.
+func NewTargetsManager(path string, config Config, maxConcurrentScrapes int, registerer prometheus.Registerer) *TargetsManager {
+	m := &TargetsManager{
+		path:       path,
+		config:     config,
+		registerer: registerer,
+		exporters:  make(map[string]*LibvirtExporter),
+	}
+
+	if maxConcurrentScrapes > 0 {
+		m.scrapeSlots = make(chan struct{}, maxConcurrentScrapes)
+	}
+
+	return m
+}
+
+// readTargetsFile returns the URIs listed in the targets file, one per line.
+// Empty lines and lines starting with '#' are ignored, malformed URIs are logged and skipped.
+func readTargetsFile(path string) ([]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []string
+
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if uri, err := url.Parse(line); err != nil || uri.Scheme == "" {
+			log.Printf("%s:%d: skipping malformed libvirt URI %q\n", path, i+1, line)
+
+			continue
+		}
+
+		targets = append(targets, line)
+	}
+
+	return targets, nil
+}
+
+// Reload reads the targets file and registers or unregisters exporters so that
+// exactly the listed targets are scraped.
+func (m *TargetsManager) Reload() error {
+	targets, err := readTargetsFile(m.path)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	listed := make(map[string]bool, len(targets))
+
+	for _, uri := range targets {
+		listed[uri] = true
+
+		if _, found := m.exporters[uri]; found {
+			continue
+		}
+
+		exporter := NewLibvirtExporter(uri, m.config)
+		exporter.scrapeSlots = m.scrapeSlots
+		if err := m.targetRegisterer(uri).Register(exporter); err != nil {
+			log.Printf("Failed to add target %s: %v\n", uri, err)
+
+			continue
+		}
+
+		m.exporters[uri] = exporter
+		exporter.StartBackgroundCollection()
+		exporter.StartHealthCheck()
+		log.Printf("Added target %s\n", uri)
+	}
+
+	for uri, exporter := range m.exporters {
+		if listed[uri] {
+			continue
+		}
+
+		m.targetRegisterer(uri).Unregister(exporter)
+		exporter.StopBackgroundCollection()
+		exporter.StopHealthCheck()
+		exporter.Close()
+		delete(m.exporters, uri)
+		log.Printf("Removed target %s\n", uri)
+	}
+
+	return nil
+}
+
+// URIs returns the libvirt URIs currently scraped, sorted.
+func (m *TargetsManager) URIs() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	uris := make([]string, 0, len(m.exporters))
+	for uri := range m.exporters {
+		uris = append(uris, uri)
+	}
+	sort.Strings(uris)
+
+	return uris
+}
+
+// targetRegisterer labels the metrics of a target with its host, the URI of the
+// target without credentials.
+func (m *TargetsManager) targetRegisterer(uri string) prometheus.Registerer {
+	return prometheus.WrapRegistererWith(prometheus.Labels{"host": redactURI(uri)}, m.registerer)
+}
+
+// Watch reloads the targets file whenever it changes. It blocks until the watcher
+// fails, and always returns why.
+func (m *TargetsManager) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	defer watcher.Close()
+
+	// Watch the directory rather than the file itself, as editors and
+	// configuration management tools tend to replace the file on save.
+	if err = watcher.Add(filepath.Dir(m.path)); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return errors.New("the watcher of the targets file was closed")
+			}
+
+			if filepath.Clean(event.Name) != filepath.Clean(m.path) || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+
+			if err := m.Reload(); err != nil {
+				log.Printf("Failed to reload targets file %s: %v\n", m.path, err)
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return errors.New("the watcher of the targets file was closed")
+			}
+
+			return err
+		}
+	}
+}
+
+func logLibvirtError(err error) {
+	// "Requested operation is not valid: domain is not running" and similar issues
+	if libvirtErr, ok := err.(libvirt.Error); ok && libvirtErr.Code == libvirt.ERR_OPERATION_INVALID && libvirtErr.Domain == libvirt.FROM_DOMAIN {
+		return
+	} else {
+		suppressed, ok := errorLogLimiter.allow(err.Error(), time.Now())
+		if !ok {
+			return
+		}
+
+		_, cFile, cLine, _ := runtime.Caller(1)
+		if suppressed > 0 {
+			log.Printf("%s:%d: %s (repeated %d times in the last %v)", cFile, cLine, err.Error(), suppressed, errorLogInterval)
+		} else {
+			log.Printf("%s:%d: %s", cFile, cLine, err.Error())
+		}
+	}
+}
+
+// errorLogInterval is the minimum time between two logs of the same error, not to
+// flood the logs on every scrape while libvirtd is down.
+const errorLogInterval = time.Minute
+
+var errorLogLimiter = logLimiter{entries: make(map[string]*logLimiterEntry)}
+
+// logLimiter keeps track of when every distinct message was last logged.
+type logLimiter struct {
+	entries map[string]*logLimiterEntry
+	mutex   sync.Mutex
 }
 
-func MemoryStatCollect(memorystat *[]libvirt.DomainMemoryStat) libvirt_schema.VirDomainMemoryStats {
-	var MemoryStats libvirt_schema.VirDomainMemoryStats
+type logLimiterEntry struct {
+	logged     time.Time
+	suppressed int
+}
 
-	for _, domainmemorystat := range *memorystat {
-		switch domainmemorystat.Tag {
-		case int32(libvirt.DOMAIN_MEMORY_STAT_MAJOR_FAULT):
-			MemoryStats.MajorFault = domainmemorystat.Val
-		case int32(libvirt.DOMAIN_MEMORY_STAT_MINOR_FAULT):
-			MemoryStats.MinorFault = domainmemorystat.Val
-		case int32(libvirt.DOMAIN_MEMORY_STAT_UNUSED):
-			MemoryStats.Unused = domainmemorystat.Val
-		case int32(libvirt.DOMAIN_MEMORY_STAT_AVAILABLE):
-			MemoryStats.Available = domainmemorystat.Val
-		case int32(libvirt.DOMAIN_MEMORY_STAT_ACTUAL_BALLOON):
-			MemoryStats.ActualBalloon = domainmemorystat.Val
-		case int32(libvirt.DOMAIN_MEMORY_STAT_RSS):
-			MemoryStats.Rss = domainmemorystat.Val
-		case int32(libvirt.DOMAIN_MEMORY_STAT_USABLE):
-			MemoryStats.Usable = domainmemorystat.Val
-		case int32(libvirt.DOMAIN_MEMORY_STAT_DISK_CACHES):
-			MemoryStats.DiskCaches = domainmemorystat.Val
+// allow returns whether the message can be logged now and, if so, how many times
+// it was suppressed since it was last logged.
+func (l *logLimiter) allow(message string, now time.Time) (int, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entry, ok := l.entries[message]
+	if ok && now.Sub(entry.logged) < errorLogInterval {
+		entry.suppressed++
+
+		return 0, false
+	}
+
+	// Forget the other messages which weren't logged for a while, they may never come
+	// back. Those which were suppressed are kept, to report how many times when they do.
+	for m, e := range l.entries {
+		if now.Sub(e.logged) >= errorLogInterval && e.suppressed == 0 {
+			delete(l.entries, m)
 		}
 	}
 
-	return MemoryStats
+	suppressed := 0
+	if ok {
+		suppressed = entry.suppressed
+	}
+	l.entries[message] = &logLimiterEntry{logged: now}
+
+	return suppressed, true
 }
 
-// LibvirtExporter implements a Prometheus exporter for libvirt state.
-type LibvirtExporter struct {
-	uri      string
-	login    string
-	password string
-	conn     *libvirt.Connect
+// version of the exporter, set at build time with -ldflags "-X main.version=...".
+var version = "unknown"
+
+// jsonMetricsPath is where the metrics are served as JSON with --web.enable-json.
+const jsonMetricsPath = "/metrics.json"
+
+// jsonMetric holds a metric served by JSONHandler. Counters, gauges and untyped
+// metrics have a value, summaries and histograms a sum and a count.
+type jsonMetric struct {
+	Labels map[string]string `json:"labels"`
+	Value  *float64          `json:"value,omitempty"`
+	Sum    *float64          `json:"sum,omitempty"`
+	Count  *uint64           `json:"count,omitempty"`
 }
 
-// NewLibvirtExporter creates a new Prometheus exporter for libvirt.
-func NewLibvirtExporter(uri string, login string, password string) *LibvirtExporter {
-	return &LibvirtExporter{
-		conn:     nil,
-		uri:      uri,
-		login:    login,
-		password: password,
+// jsonMetricFamily holds all the metrics of a name served by JSONHandler.
+type jsonMetricFamily struct {
+	Help    string       `json:"help"`
+	Type    string       `json:"type"`
+	Metrics []jsonMetric `json:"metrics"`
+}
+
+// finite returns a pointer to value, or nil when JSON can't represent it (NaN, ±Inf).
+func finite(value float64) *float64 {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
 	}
+
+	return &value
 }
 
-// Describe returns metadata for all Prometheus metrics that may be exported.
-func (e *LibvirtExporter) Describe(ch chan<- *prometheus.Desc) {
-	// Status
-	ch <- libvirtUpDesc
+// jsonMetricFamilies converts the gathered metric families into JSONHandler's
+// document, keyed by metric name.
+func jsonMetricFamilies(families []*dto.MetricFamily) map[string]jsonMetricFamily {
+	result := make(map[string]jsonMetricFamily, len(families))
 
-	// Domain info
-	ch <- libvirtDomainInfoMaxMemDesc
-	ch <- libvirtDomainInfoMemoryUsageDesc
-	ch <- libvirtDomainInfoNrVirtCPUDesc
-	ch <- libvirtDomainInfoCPUTimeDesc
-	ch <- libvirtDomainInfoCPUStealTimeDesc
-	ch <- libvirtDomainInfoVirDomainState
+	for _, family := range families {
+		converted := jsonMetricFamily{
+			Help:    family.GetHelp(),
+			Type:    strings.ToLower(family.GetType().String()),
+			Metrics: make([]jsonMetric, 0, len(family.GetMetric())),
+		}
 
-	// Domain block stats
-	ch <- libvirtDomainBlockRdBytesDesc
-	ch <- libvirtDomainBlockRdReqDesc
-	ch <- libvirtDomainBlockRdTotalTimesDesc
-	ch <- libvirtDomainBlockWrBytesDesc
-	ch <- libvirtDomainBlockWrReqDesc
-	ch <- libvirtDomainBlockWrTotalTimesDesc
-	ch <- libvirtDomainBlockFlushReqDesc
-	ch <- libvirtDomainBlockFlushTotalTimesDesc
-	ch <- libvirtDomainBlockAllocationDesc
-	ch <- libvirtDomainBlockCapacityDesc
-	ch <- libvirtDomainBlockPhysicalSizeDesc
+		for _, metric := range family.GetMetric() {
+			sample := jsonMetric{Labels: make(map[string]string, len(metric.GetLabel()))}
+			for _, label := range metric.GetLabel() {
+				sample.Labels[label.GetName()] = label.GetValue()
+			}
 
-	// Domain net interfaces stats
-	ch <- libvirtDomainInterfaceRxBytesDesc
-	ch <- libvirtDomainInterfaceRxPacketsDesc
-	ch <- libvirtDomainInterfaceRxErrsDesc
-	ch <- libvirtDomainInterfaceRxDropDesc
-	ch <- libvirtDomainInterfaceTxBytesDesc
-	ch <- libvirtDomainInterfaceTxPacketsDesc
-	ch <- libvirtDomainInterfaceTxErrsDesc
-	ch <- libvirtDomainInterfaceTxDropDesc
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				sample.Value = finite(metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				sample.Value = finite(metric.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				sample.Value = finite(metric.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				count := metric.GetSummary().GetSampleCount()
+				sample.Sum = finite(metric.GetSummary().GetSampleSum())
+				sample.Count = &count
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				count := metric.GetHistogram().GetSampleCount()
+				sample.Sum = finite(metric.GetHistogram().GetSampleSum())
+				sample.Count = &count
+			}
 
-	// Domain memory stats
-	ch <- libvirtDomainMemoryStatMajorfaultDesc
-	ch <- libvirtDomainMemoryStatMinorFaultDesc
-	ch <- libvirtDomainMemoryStatUnusedDesc
-	ch <- libvirtDomainMemoryStatAvailableDesc
-	ch <- libvirtDomainMemoryStatActualBaloonDesc
-	ch <- libvirtDomainMemoryStatRssDesc
-	ch <- libvirtDomainMemoryStatUsableDesc
-	ch <- libvirtDomainMemoryStatDiskCachesDesc
-}
+			converted.Metrics = append(converted.Metrics, sample)
+		}
 
-// Collect scrapes Prometheus metrics from libvirt.
-func (e *LibvirtExporter) Collect(ch chan<- prometheus.Metric) {
-	err := e.CollectFromLibvirt(ch)
-	if err == nil {
-		ch <- prometheus.MustNewConstMetric(
-			libvirtUpDesc,
-			prometheus.GaugeValue,
-			1.0)
-	} else {
-		logLibvirtError(err)
-		ch <- prometheus.MustNewConstMetric(
-			libvirtUpDesc,
-			prometheus.GaugeValue,
-			0.0)
+		result[family.GetName()] = converted
 	}
-}
 
-func (e *LibvirtExporter) connectLibvirtWithAuth(uri string) (*libvirt.Connect, error) {
-	if e.login == "" || e.password == "" {
-		return nil, fmt.Errorf("Empty username or password was provided. Not attempting to authenticate using SASL")
-	}
+	return result
+}
 
-	callback := func(creds []*libvirt.ConnectCredential) {
-		for _, cred := range creds {
-			switch cred.Type {
-			case libvirt.CRED_AUTHNAME:
-				cred.Result = e.login
-				cred.ResultLen = len(cred.Result)
+// MetricsHandler serves the metrics of registry in the Prometheus formats, instrumented
+// with the promhttp metrics registered with registerer. The responses are gzip-compressed
+// for the clients accepting it.
+func MetricsHandler(registry *prometheus.Registry, registerer prometheus.Registerer) http.Handler {
+	return promhttp.InstrumentMetricHandler(registerer, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+}
 
-			case libvirt.CRED_PASSPHRASE:
-				cred.Result = e.password
-				cred.ResultLen = len(cred.Result)
+// JSONHandler serves the metrics of gatherer as a JSON document, for the consumers
+// which can't parse the Prometheus text format. The metrics which can't be gathered
+// are left out, as promhttp does with its default ContinueOnError handling.
+func JSONHandler(gatherer prometheus.Gatherer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		families, err := gatherer.Gather()
+		if err != nil {
+			log.Printf("Error gathering the metrics for %s: %v", jsonMetricsPath, err)
+		}
 
-			case libvirt.CRED_USERNAME:
-			case libvirt.CRED_LANGUAGE:
-			case libvirt.CRED_CNONCE:
-			case libvirt.CRED_ECHOPROMPT:
-			case libvirt.CRED_NOECHOPROMPT:
-			case libvirt.CRED_REALM:
-			case libvirt.CRED_EXTERNAL:
-				// FIXME: not implemented
-				continue
-			}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(jsonMetricFamilies(families)); err != nil {
+			log.Printf("Failed to write %s: %v", jsonMetricsPath, err)
 		}
+	})
+}
+
+// landingPage holds what is shown on the landing page of the exporter.
+type landingPage struct {
+	Version     string
+	MetricsPath string
+	JSONPath    string
+	Collectors  []string
+	URIs        []string
+}
+
+var landingPageTemplate = template.Must(template.New("landing").Parse(`<html>
+<head><title>Libvirt Exporter</title></head>
+<body>
+<h1>Libvirt Exporter</h1>
+<p>Version: {{.Version}}</p>
+<p><a href="{{.MetricsPath}}">Metrics</a></p>
+{{if .JSONPath}}<p><a href="{{.JSONPath}}">Metrics as JSON</a></p>
+{{end}}<h2>Libvirt URIs</h2>
+<ul>
+{{range .URIs}}<li>{{.}}</li>
+{{end}}</ul>
+<h2>Enabled collectors</h2>
+<ul>
+{{range .Collectors}}<li>{{.}}</li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+// redactURI hides the password a libvirt URI may contain, for display.
+func redactURI(uri string) string {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return "(invalid URI)"
 	}
 
-	auth := &libvirt.ConnectAuth{
-		CredType: []libvirt.ConnectCredentialType{
-			libvirt.CRED_AUTHNAME, libvirt.CRED_PASSPHRASE,
-		},
-		Callback: callback,
+	return parsed.Redacted()
+}
+
+// ListenAndServe binds every address and serves handler on all of them.
+// It fails without serving anything if any address can't be bound, and
+// otherwise returns when the first listener stops.
+func ListenAndServe(addresses []string, handler http.Handler) error {
+	listeners, err := listen(addresses)
+	if err != nil {
+		return err
 	}
 
-	return libvirt.NewConnectWithAuth(uri, auth, 0) // connect flag 0 means "read-write"
+	server := &http.Server{Handler: handler}
+	done := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		log.Printf("Listening on %s", listener.Addr())
+		go func(listener net.Listener) {
+			done <- server.Serve(listener)
+		}(listener)
+	}
+	err = <-done
+	server.Close()
+	return err
 }
 
-func (e *LibvirtExporter) Connect() (bool, error) {
-	var err error
+// listen binds every address, closing them all if any fails.
+func listen(addresses []string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	var errs []string
+	for _, address := range addresses {
+		listener, err := net.Listen(listenNetwork(address), address)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(errs) > 0 {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		return nil, fmt.Errorf("failed to listen: %s", strings.Join(errs, "; "))
+	}
 
-	// First, try to connect without authentication, and with the full access
-	if e.conn, err = libvirt.NewConnect(e.uri); err == nil {
-		return false, nil
+	return listeners, nil
+}
+
+// listenNetwork returns the network to listen on for an address. An IPv6 wildcard
+// like [::]:9177 would otherwise also take the IPv4 addresses, and conflict with
+// 0.0.0.0:9177; a host name or an empty host still gets both.
+func listenNetwork(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "tcp"
 	}
 
-	// Then, if the connection has failed, we try accessing libvirt with the authentication
-	if e.conn, err = e.connectLibvirtWithAuth(e.uri); err == nil {
-		return false, nil
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
 	}
+}
 
-	// Then, if the authenticated connection failed we attempt to connect using readonly
-	if e.conn, err = libvirt.NewConnectReadOnly(e.uri); err == nil {
-		return true, nil
+// uuidSet returns the given UUIDs as a set, in lower case like libvirt formats them.
+func uuidSet(uuids []string) map[string]bool {
+	set := make(map[string]bool, len(uuids))
+	for _, uuid := range uuids {
+		set[strings.ToLower(strings.TrimSpace(uuid))] = true
 	}
 
-	return true, err
+	return set
 }
 
-func (e *LibvirtExporter) Close() {
-	e.conn.Close()
+// readCredentialFile returns the content of a file holding a credential, such as
+// a mounted Docker or Kubernetes secret, without its trailing newline.
+func readCredentialFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(content), "\r\n"), nil
 }
 
-// CollectFromLibvirt obtains Prometheus metrics from all domains in a
-// libvirt setup.
-func (e *LibvirtExporter) CollectFromLibvirt(ch chan<- prometheus.Metric) error {
-	readOnly, err := e.Connect()
+// StartGraphiteBridge pushes the metrics of gatherer to the Graphite server at address
+// every interval, with their names prefixed, until ctx is done. The failed pushes are
+// logged and retried at the next interval.
+func StartGraphiteBridge(ctx context.Context, address string, prefix string, interval time.Duration, gatherer prometheus.Gatherer) error {
+	bridge, err := graphite.NewBridge(&graphite.Config{
+		URL:           address,
+		Gatherer:      gatherer,
+		Prefix:        prefix,
+		Interval:      interval,
+		Logger:        log.Default(),
+		ErrorHandling: graphite.ContinueOnError,
+	})
 	if err != nil {
 		return err
 	}
 
-	defer e.Close()
+	go bridge.Run(ctx)
+
+	return nil
+}
+
+// NewRegistry creates a registry holding the metrics about the exporter process
+// itself, to which the exporters are then registered. Unlike the default registry,
+// every test can use its own. The constant labels are added to the metrics about
+// the process, the exporters have to be registered with them as well.
+func NewRegistry(constLabels prometheus.Labels) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	prometheus.WrapRegistererWith(constLabels, registry).MustRegister(
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewGoCollector())
+
+	return registry
+}
+
+// ParseConstLabel parses a constant label given as name=value.
+func ParseConstLabel(label string) (string, string, error) {
+	name, value, found := strings.Cut(label, "=")
+	if !found || !labelNameRegexp.MatchString(name) {
+		return "", "", fmt.Errorf("Malformed constant label %q, expected labelname=value", label)
+	}
+
+	return name, value, nil
+}
+
+// ValidateSchema parses the XML description of every domain of the given libvirt
+// URI with libvirt_schema, and logs the top-level elements of each domain which
+// the schema ignores along with their raw XML, so that it can be kept up to date
+// with libvirt.
+func ValidateSchema(uri string, config Config) error {
+	exporter := NewLibvirtExporter(uri, config)
+	defer exporter.Close()
 
-	stats, err := e.conn.GetAllDomainStats([]*libvirt.Domain{}, libvirt.DOMAIN_STATS_STATE|libvirt.DOMAIN_STATS_CPU_TOTAL|
-		libvirt.DOMAIN_STATS_INTERFACE|libvirt.DOMAIN_STATS_BALLOON|libvirt.DOMAIN_STATS_BLOCK|
-		libvirt.DOMAIN_STATS_PERF|libvirt.DOMAIN_STATS_VCPU, 0)
+	conn, _, err := exporter.Connect()
 	if err != nil {
 		return err
 	}
 
-	for _, stat := range stats {
-		if err = CollectDomain(ch, stat); err != nil {
-			logLibvirtError(err)
+	domains, err := conn.ListDomains(0)
+	if err != nil {
+		return err
+	}
 
-			if err = stat.Domain.Free(); err != nil {
-				logLibvirtError(err)
-			}
+	var unparsedDomains int
 
-			continue
+	for _, domain := range domains {
+		name, unparsed, err := unparsedElements(domain)
+		if freeErr := domain.Free(); freeErr != nil {
+			logLibvirtError(freeErr)
 		}
 
-		if !readOnly {
-			if err = CollectDomainStealTime(ch, stat.Domain); err != nil {
-				logLibvirtError(err)
+		if err != nil {
+			log.Printf("Failed to validate the schema of domain %s: %v\n", name, err)
+			unparsedDomains++
 
-				if err = stat.Domain.Free(); err != nil {
-					logLibvirtError(err)
-				}
+			continue
+		}
 
-				continue
+		if len(unparsed) == 0 {
+			continue
+		}
+
+		var names []string
+		seen := make(map[string]bool, len(unparsed))
+		for _, element := range unparsed {
+			if !seen[element.name] {
+				seen[element.name] = true
+				names = append(names, element.name)
 			}
 		}
 
-		if err = stat.Domain.Free(); err != nil {
-			logLibvirtError(err)
+		log.Printf("Domain %s: elements not parsed: %s\n", name, strings.Join(names, ", "))
+		for _, element := range unparsed {
+			log.Printf("Domain %s: %s\n", name, element.raw)
 		}
+		unparsedDomains++
 	}
 
+	log.Printf("Validated the schema against %d domains, %d with elements not parsed\n", len(domains), unparsedDomains)
+
 	return nil
 }
 
-func logLibvirtError(err error) {
-	// "Requested operation is not valid: domain is not running" and similar issues
-	if err.(libvirt.Error).Code == libvirt.ERR_OPERATION_INVALID && err.(libvirt.Error).Domain == libvirt.FROM_DOMAIN {
-		return
-	} else {
-		_, cFile, cLine, _ := runtime.Caller(1)
-		log.Printf("%s:%d: %s", cFile, cLine, err.Error())
+// xmlElement is an element of an XML document, with its raw XML.
+type xmlElement struct {
+	name string
+	raw  string
+}
+
+// unparsedElements returns the name of the domain and the top-level elements of
+// its XML description which are lost once parsed with libvirt_schema and marshalled again.
+func unparsedElements(domain DomainHandle) (string, []xmlElement, error) {
+	name, err := domain.GetName()
+	if err != nil {
+		return "", nil, err
+	}
+
+	xmlDesc, err := domain.GetXMLDesc(0)
+	if err != nil {
+		return name, nil, err
+	}
+
+	var desc libvirt_schema.Domain
+	if err = xml.Unmarshal([]byte(xmlDesc), &desc); err != nil {
+		return name, nil, err
+	}
+
+	parsedXML, err := xml.Marshal(desc)
+	if err != nil {
+		return name, nil, err
+	}
+
+	rawElements, err := topLevelElements([]byte(xmlDesc))
+	if err != nil {
+		return name, nil, err
+	}
+
+	parsedElements, err := topLevelElements(parsedXML)
+	if err != nil {
+		return name, nil, err
+	}
+
+	parsed := make(map[string]bool, len(parsedElements))
+	for _, element := range parsedElements {
+		parsed[element.name] = true
+	}
+
+	var unparsed []xmlElement
+	for _, element := range rawElements {
+		if !parsed[element.name] {
+			unparsed = append(unparsed, element)
+		}
+	}
+
+	return name, unparsed, nil
+}
+
+// topLevelElements returns the children of the root element of an XML document,
+// in order of appearance.
+func topLevelElements(data []byte) ([]xmlElement, error) {
+	var (
+		decoder  = xml.NewDecoder(bytes.NewReader(data))
+		depth    int
+		start    int64
+		elements []xmlElement
+	)
+
+	for {
+		// The end of the previous token, and thus the start of an element
+		offset := decoder.InputOffset()
+
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return elements, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 2 {
+				start = offset
+				elements = append(elements, xmlElement{name: t.Name.Local})
+			}
+		case xml.EndElement:
+			if depth == 2 {
+				elements[len(elements)-1].raw = string(data[start:decoder.InputOffset()])
+			}
+			depth--
+		}
 	}
 }
 
+// libvirtURIFlag adds the --libvirt.uri flag to the application. Like with the other
+// libvirt tools, LIBVIRT_DEFAULT_URI replaces the default URI, the flag overriding both.
+func libvirtURIFlag(app *kingpin.Application) *string {
+	return app.Flag("libvirt.uri", "Libvirt URI from which to extract metrics (you can also use LIBVIRT_DEFAULT_URI environment variable)").Default("qemu:///system").Envar("LIBVIRT_DEFAULT_URI").String()
+}
+
 func main() {
 	var (
-		app             = kingpin.New("libvirt_exporter", "Prometheus metrics exporter for libvirt")
-		listenAddress   = app.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9177").String()
-		metricsPath     = app.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
-		libvirtURI      = app.Flag("libvirt.uri", "Libvirt URI from which to extract metrics.").Default("qemu:///system").String()
-		libvirtUsername = app.Flag("libvirt.auth.username", "User name for SASL login (you can also use LIBVIRT_EXPORTER_USERNAME environment variable)").Default("").Envar("LIBVIRT_EXPORTER_USERNAME").String()
-		libvirtPassword = app.Flag("libvirt.auth.password", "Password for SASL login (you can also use LIBVIRT_EXPORTER_PASSWORD environment variable)").Default("").Envar("LIBVIRT_EXPORTER_PASSWORD").String()
+		app                     = kingpin.New("libvirt_exporter", "Prometheus metrics exporter for libvirt")
+		listenAddresses         = app.Flag("web.listen-address", "Address to listen on for web interface and telemetry. Can be repeated, e.g. to bind both 0.0.0.0:9177 and [::]:9177.").Default(":9177").Strings()
+		metricsPath             = app.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
+		enableJSON              = app.Flag("web.enable-json", "Also expose the metrics as JSON under /metrics.json.").Default("false").Bool()
+		graphiteAddress         = app.Flag("graphite.address", "Address (host:port) of a Graphite server to also push the metrics to. Disabled when empty.").Default("").String()
+		graphitePrefix          = app.Flag("graphite.prefix", "Prefix of the metrics pushed to Graphite.").Default("libvirt_exporter").String()
+		graphiteInterval        = app.Flag("graphite.interval", "Interval between pushes of the metrics to Graphite.").Default("15s").Duration()
+		libvirtURI              = libvirtURIFlag(app)
+		targetsFile             = app.Flag("libvirt.targets-file", "File listing the libvirt URIs to extract metrics from, one per line. Reloaded on change, overrides --libvirt.uri.").Default("").String()
+		maxTargetScrapes        = app.Flag("libvirt.targets-max-concurrent-scrapes", "Maximum number of targets from --libvirt.targets-file scraped at the same time, 0 means unlimited.").Default("8").Int()
+		background              = app.Flag("collector.background", "Collect the metrics from libvirt in the background every --collector.interval, the scrapes then serve the latest collection instead of waiting for libvirt.").Default("false").Bool()
+		healthCheckInterval     = app.Flag("libvirt.healthcheck-interval", "Interval between the health checks of the connection to libvirt, which reconnect when libvirt doesn't answer. 0 disables them.").Default("0s").Duration()
+		backgroundInterval      = app.Flag("collector.interval", "Interval between the collections made in the background with --collector.background.").Default("30s").Duration()
+		cacheTTL                = app.Flag("collector.cache-ttl", "Serve the metrics collected from libvirt to the scrapes within this duration instead of collecting them again, e.g. for several Prometheus servers. 0 disables the cache.").Default("0s").Duration()
+		maxRPCs                 = app.Flag("libvirt.max-concurrent-rpcs", "Maximum number of libvirt calls made at the same time across all targets, 0 means unlimited.").Default("0").Int()
+		metricNamespace         = app.Flag("metric.namespace", "Namespace (prefix) of the exported metrics.").Default("libvirt").String()
+		libvirtUsername         = app.Flag("libvirt.auth.username", "User name for SASL login (you can also use LIBVIRT_EXPORTER_USERNAME environment variable)").Default("").Envar("LIBVIRT_EXPORTER_USERNAME").String()
+		libvirtPassword         = app.Flag("libvirt.auth.password", "Password for SASL login (you can also use LIBVIRT_EXPORTER_PASSWORD environment variable)").Default("").Envar("LIBVIRT_EXPORTER_PASSWORD").String()
+		libvirtUsernameFile     = app.Flag("libvirt.auth.username-file", "File holding the user name for SASL login, overrides --libvirt.auth.username.").Default("").String()
+		libvirtPasswordFile     = app.Flag("libvirt.auth.password-file", "File holding the password for SASL login, overrides --libvirt.auth.password.").Default("").String()
+		libvirtReadOnlyFirst    = app.Flag("libvirt.read-only-first", "Open a read-only connection, without authentication, and only reconnect read-write once a running domain needs the QEMU monitor (steal time, QEMU process, KVM debugfs, QMP). Falls back to a read-write connection if it fails.").Default("false").Bool()
+		libvirtTLSInsecure      = app.Flag("libvirt.tls-insecure", "Don't verify the certificate of libvirtd for TLS connections, for testing only.").Default("false").Bool()
+		libvirtReadOnly         = app.Flag("libvirt.read-only", "Only open read-only connections to libvirt. The metrics relying on the QEMU monitor (steal time, QEMU process, QMP block statistics) aren't collected.").Default("false").Bool()
+		collectInfo             = app.Flag("collector.info", "Collect the general domain information (memory, vCPUs, CPU time, state).").Default("true").Bool()
+		collectDomainXML        = app.Flag("collector.domain-xml", "Collect the metrics and labels derived from the XML description of the domains (CPU model, firmware, devices, block source for network disks, interface bridge).").Default("true").Bool()
+		collectBlock            = app.Flag("collector.block", "Collect the block device statistics.").Default("true").Bool()
+		collectBlockBacking     = app.Flag("collector.block-backing", "Collect the capacity of the images of the backing chains of the disks, along with the block device statistics.").Default("false").Bool()
+		collectBlockJobs        = app.Flag("collector.block-jobs", "Collect the progress of the block jobs (pull, commit, copy), one call per block device.").Default("true").Bool()
+		collectInterface        = app.Flag("collector.interface", "Collect the network interface statistics.").Default("true").Bool()
+		collectMemory           = app.Flag("collector.memory", "Collect the memory (balloon) statistics.").Default("true").Bool()
+		collectStealTime        = app.Flag("collector.steal-time", "Collect the CPU steal time, requires a read-write connection.").Default("true").Bool()
+		stealTimeAggregateOnly  = app.Flag("collector.steal-time-aggregate-only", "Only collect the total steal time of every domain, not the one of each vCPU.").Default("false").Bool()
+		stealTimeQMPCommand     = app.Flag("collector.steal-time-qmp-command", "QMP command listing the CPU threads of QEMU, for the QEMU builds without query-cpus-fast and query-cpus, which are tried when empty. Only x-query-cpus-fast and x-query-cpus are allowed besides them.").Default("").String()
+		stealTimeQMPCPUField    = app.Flag("collector.steal-time-qmp-cpu-field", "Field of the result of --collector.steal-time-qmp-command holding the CPU index.").Default("cpu-index").String()
+		stealTimeQMPThreadField = app.Flag("collector.steal-time-qmp-thread-field", "Field of the result of --collector.steal-time-qmp-command holding the PID of the CPU thread.").Default("thread-id").String()
+		stealTimeDomains        = app.Flag("collector.steal-time-domains", "Regular expression matching the names of the domains whose QEMU monitor is used, for the steal time and the other collectors relying on it. The other domains only get the other metrics. All domains when empty.").Default("").String()
+		collectQemuProcess      = app.Flag("collector.qemu-process", "Collect the resource usage of the QEMU processes from /proc, requires a read-write connection.").Default("true").Bool()
+		collectKVMDebugfs       = app.Flag("collector.kvm-debugfs", "Collect the halt-polling statistics of the vCPUs from the KVM debugfs, requires root and a read-write connection.").Default("false").Bool()
+		collectQMPBlockStats    = app.Flag("collector.qmp-blockstats", "Collect the block device statistics only available from QEMU (merged and invalid requests, idle time, latency), requires a read-write connection.").Default("false").Bool()
+		qmpCustomFile           = app.Flag("collector.qmp-custom", "JSON file listing QMP query commands and the fields of their results to export as gauges, see the README. Requires a read-write connection.").Default("").String()
+		collectNodeCaps         = app.Flag("collector.node-caps", "Collect the capabilities of the host (machine types, maximum vCPUs).").Default("false").Bool()
+		collectNodeCPUFreq      = app.Flag("collector.node-cpufreq", "Collect the current frequency of the host CPUs, read from the sysfs of the host running the exporter, for the local libvirt URIs only.").Default("false").Bool()
+		includeInactive         = app.Flag("collector.include-inactive", "Collect the metrics of the shut off domains, derived from their configuration.").Default("true").Bool()
+		collectCPUFeatures      = app.Flag("collector.cpu-features", "Collect the CPU features of the domains, one series per feature.").Default("false").Bool()
+		collectMigrations       = app.Flag("collector.migrations", "Count the domains being migrated to or from the host, one call per active domain.").Default("false").Bool()
+		collectBlkio            = app.Flag("collector.blkio", "Collect the block I/O weights of the domains with block I/O tuning, one call per such domain.").Default("false").Bool()
+		collectMemtune          = app.Flag("collector.memtune", "Collect the memory limits of the domains with memory tuning, one call per such domain, and whether their memory is locked.").Default("false").Bool()
+		collectConfigHash       = app.Flag("collector.config-hash", "Collect a hash of the persistent XML description of the domains, one more call per domain.").Default("false").Bool()
+		collectEvents           = app.Flag("collector.events", "Count the watchdog and panic events of the domains, runs the libvirt event loop in the background.").Default("false").Bool()
+		legacyMetrics           = app.Flag("compat.legacy-metrics", "Also export the deprecated metrics under their former names and types, see the README.").Default("false").Bool()
+		statsGroups             = app.Flag("collector.stats-groups", "Comma-separated statistics groups requested for every domain, among state, cpu-total, balloon, vcpu, interface, block, perf, iothread, memory, dirtyrate and vm. state is always requested.").Default("state,cpu-total,balloon,vcpu,interface,block,perf").String()
+		maxDomains              = app.Flag("collector.max-domains", "Maximum number of domains collected per scrape, the others are left out with a warning. 0 means unlimited.").Default("0").Int()
+		domainUUIDAllowlist     = app.Flag("libvirt.domain-uuid-allowlist", "UUID of a domain to collect, the other domains are only counted. Can be repeated, all domains are collected when unset.").Strings()
+		domainUUIDDenylist      = app.Flag("libvirt.domain-uuid-denylist", "UUID of a domain never to collect, even if allowlisted, it is only counted. Can be repeated.").Strings()
+		constLabelFlags         = app.Flag("metrics.const-label", "Label added to all the exported metrics, as labelname=value (e.g. host=hv01). Can be repeated.").Strings()
+		metadataSelector        = app.Flag("libvirt.metadata-selector", "Only collect the domains whose metadata element or attribute has the given value, as namespace:path=value (e.g. http://example.com/xmlns/monitoring:monitoring/@enabled=true). The other domains are only counted.").Default("").String()
+		metadataLabels          = app.Flag("libvirt.metadata-labels", "Domain metadata element exposed as a label of the libvirt_domain_metadata metric, as labelname=namespace:path (e.g. project=http://openstack.org/xmlns/libvirt/nova/1.1:instance/owner/project/@uuid). Can be repeated.").Strings()
+	)
+
+	app.Version(version)
+	var (
+		_              = app.Command("serve", "Serve the metrics of libvirt.").Default()
+		validateSchema = app.Command("validate-schema", "Log the elements of the XML description of the domains of --libvirt.uri which aren't parsed by the exporter, with their raw XML, then exit.")
 	)
+	command := kingpin.MustParse(app.Parse(os.Args[1:]))
+
+	config := Config{
+		Login:         *libvirtUsername,
+		Password:      *libvirtPassword,
+		Namespace:     *metricNamespace,
+		ReadOnly:      *libvirtReadOnly,
+		ReadOnlyFirst: *libvirtReadOnlyFirst,
+		TLSInsecure:   *libvirtTLSInsecure,
+		CacheTTL:      *cacheTTL,
+		LegacyMetrics: *legacyMetrics,
+		MaxDomains:    *maxDomains,
+		Collectors: Collectors{
+			Info:                   *collectInfo,
+			DomainXML:              *collectDomainXML,
+			Block:                  *collectBlock,
+			BlockJobs:              *collectBlockJobs,
+			BlockBacking:           *collectBlockBacking,
+			Interface:              *collectInterface,
+			Memory:                 *collectMemory,
+			StealTime:              *collectStealTime,
+			StealTimeAggregateOnly: *stealTimeAggregateOnly,
+			QemuProcess:            *collectQemuProcess,
+			KVMDebugfs:             *collectKVMDebugfs,
+			QMPBlockStats:          *collectQMPBlockStats,
+			NodeCaps:               *collectNodeCaps,
+			NodeCPUFreq:            *collectNodeCPUFreq,
+			IncludeInactive:        *includeInactive,
+			CPUFeatures:            *collectCPUFeatures,
+			Events:                 *collectEvents,
+			Migrations:             *collectMigrations,
+			Blkio:                  *collectBlkio,
+			Memtune:                *collectMemtune,
+			ConfigHash:             *collectConfigHash,
+		},
+	}
+
+	if *libvirtUsernameFile != "" {
+		login, err := readCredentialFile(*libvirtUsernameFile)
+		app.FatalIfError(err, "invalid --libvirt.auth.username-file")
+		config.Login = login
+	}
+
+	if *libvirtPasswordFile != "" {
+		password, err := readCredentialFile(*libvirtPasswordFile)
+		app.FatalIfError(err, "invalid --libvirt.auth.password-file")
+		config.Password = password
+	}
+
+	if *stealTimeDomains != "" {
+		domains, err := regexp.Compile("^(?:" + *stealTimeDomains + ")$")
+		app.FatalIfError(err, "invalid --collector.steal-time-domains")
+		config.QemuMonitorDomains = domains
+	}
+
+	if *stealTimeQMPCommand != "" {
+		command, err := NewQemuThreadsCommand(*stealTimeQMPCommand, *stealTimeQMPCPUField, *stealTimeQMPThreadField)
+		app.FatalIfError(err, "invalid --collector.steal-time-qmp-command")
+		config.QemuThreadsCommand = command
+	}
+
+	groups, err := ParseStatsGroups(*statsGroups)
+	app.FatalIfError(err, "invalid --collector.stats-groups")
+	config.StatsGroups = groups
+
+	if *metadataSelector != "" {
+		config.MetadataSelector, err = ParseMetadataSelector(*metadataSelector)
+		app.FatalIfError(err, "invalid --libvirt.metadata-selector")
+	}
+
+	config.DomainUUIDAllowlist = uuidSet(*domainUUIDAllowlist)
+	config.DomainUUIDDenylist = uuidSet(*domainUUIDDenylist)
+
+	// Not even described, as they can't be collected
+	if config.ReadOnly {
+		config.Collectors.StealTime = false
+		config.Collectors.QemuProcess = false
+		config.Collectors.KVMDebugfs = false
+		config.Collectors.QMPBlockStats = false
+	}
+
+	if *background {
+		if *backgroundInterval <= 0 {
+			app.Fatalf("invalid --collector.interval: must be positive")
+		}
+
+		config.BackgroundInterval = *backgroundInterval
+	}
+
+	if *healthCheckInterval < 0 {
+		app.Fatalf("invalid --libvirt.healthcheck-interval: must not be negative")
+	}
+	config.HealthCheckInterval = *healthCheckInterval
+
+	if *maxRPCs > 0 {
+		config.RPCSlots = make(chan struct{}, *maxRPCs)
+	}
+
+	for _, mapping := range *metadataLabels {
+		label, err := ParseMetadataLabel(mapping)
+		app.FatalIfError(err, "invalid --libvirt.metadata-labels")
+		config.MetadataLabels = append(config.MetadataLabels, label)
+	}
+
+	// Not even loaded with a read-only connection, as they can't be collected
+	if *qmpCustomFile != "" && !config.ReadOnly {
+		config.QMPCustomCommands, err = LoadQMPCustomCommands(*qmpCustomFile, *metricNamespace)
+		app.FatalIfError(err, "invalid --collector.qmp-custom")
+	}
+
+	if command == validateSchema.FullCommand() {
+		app.FatalIfError(ValidateSchema(*libvirtURI, config), "failed to validate the schema")
+		return
+	}
+
+	if config.Collectors.Events {
+		app.FatalIfError(RunEventLoop(), "failed to start the libvirt event loop")
+	}
 
-	kingpin.MustParse(app.Parse(os.Args[1:]))
+	constLabels := make(prometheus.Labels, len(*constLabelFlags))
+	for _, label := range *constLabelFlags {
+		name, value, err := ParseConstLabel(label)
+		app.FatalIfError(err, "invalid --metrics.const-label")
+		constLabels[name] = value
+	}
+
+	registry := NewRegistry(constLabels)
+	registerer := prometheus.WrapRegistererWith(constLabels, registry)
+
+	var manager *TargetsManager
+	if *targetsFile != "" {
+		manager = NewTargetsManager(*targetsFile, config, *maxTargetScrapes, registerer)
+		if err := manager.Reload(); err != nil {
+			log.Fatalf("Failed to read targets file: %v", err)
+		}
 
-	exporter := NewLibvirtExporter(*libvirtURI, *libvirtUsername, *libvirtPassword)
-	prometheus.MustRegister(exporter)
+		go func() {
+			log.Fatalf("Failed to watch targets file: %v", manager.Watch())
+		}()
+	} else {
+		exporter := NewLibvirtExporter(*libvirtURI, config)
+		app.FatalIfError(registerer.Register(exporter), "invalid --metrics.const-label")
+		exporter.StartBackgroundCollection()
+		exporter.StartHealthCheck()
+	}
+
+	if *graphiteAddress != "" {
+		err := StartGraphiteBridge(context.Background(), *graphiteAddress, *graphitePrefix, *graphiteInterval, registry)
+		app.FatalIfError(err, "invalid --graphite.address")
+	}
 
-	http.Handle(*metricsPath, promhttp.Handler())
+	http.Handle(*metricsPath, MetricsHandler(registry, registerer))
+	if *enableJSON {
+		http.Handle(jsonMetricsPath, JSONHandler(registry))
+	}
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		_, _ = w.Write([]byte(`
-			<html>
-			<head><title>Libvirt Exporter</title></head>
-			<body>
-			<h1>Libvirt Exporter</h1>
-			<p><a href='` + *metricsPath + `'>Metrics</a></p>
-			</body>
-			</html>`))
+		page := landingPage{
+			Version:     version,
+			MetricsPath: *metricsPath,
+			Collectors:  config.Collectors.Enabled(),
+		}
+		if *enableJSON {
+			page.JSONPath = jsonMetricsPath
+		}
+		if manager != nil {
+			page.URIs = manager.URIs()
+		} else {
+			page.URIs = []string{*libvirtURI}
+		}
+
+		for i, uri := range page.URIs {
+			page.URIs[i] = redactURI(uri)
+		}
+
+		if err := landingPageTemplate.Execute(w, page); err != nil {
+			log.Printf("Failed to render the landing page: %v", err)
+		}
 	})
 
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	log.Fatal(ListenAndServe(*listenAddresses, nil))
 }
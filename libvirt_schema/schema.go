@@ -13,20 +13,210 @@
 
 package libvirt_schema
 
+import "encoding/xml"
+
 type Domain struct {
-	Devices Devices `xml:"devices"`
+	Type          string       `xml:"type,attr"`
+	Title         string       `xml:"title"`
+	Description   string       `xml:"description"`
+	CurrentMemory ScaledMemory `xml:"currentMemory"`
+	Metadata      Metadata     `xml:"metadata"`
+	OS            OS           `xml:"os"`
+	CPU           *CPU         `xml:"cpu"`
+	Devices       Devices      `xml:"devices"`
+
+	LaunchSecurity *LaunchSecurity `xml:"launchSecurity"`
+	MemoryBacking  *MemoryBacking  `xml:"memoryBacking"`
+	Numatune       *Numatune       `xml:"numatune"`
+	Blkiotune      *struct{}       `xml:"blkiotune"`
+	Memtune        *struct{}       `xml:"memtune"`
+}
+
+type Numatune struct {
+	Memory   *NumatuneMemory   `xml:"memory"`
+	MemNodes []NumatuneMemNode `xml:"memnode"`
+}
+
+type NumatuneMemory struct {
+	Mode    string `xml:"mode,attr"`
+	Nodeset string `xml:"nodeset,attr"`
+}
+
+type NumatuneMemNode struct {
+	CellID  string `xml:"cellid,attr"`
+	Mode    string `xml:"mode,attr"`
+	Nodeset string `xml:"nodeset,attr"`
+}
+
+type ScaledMemory struct {
+	Value uint64 `xml:",chardata"`
+	Unit  string `xml:"unit,attr"`
+}
+
+type MemoryBacking struct {
+	Hugepages *Hugepages `xml:"hugepages"`
+	Locked    *struct{}  `xml:"locked"`
+}
+
+type Hugepages struct {
+	Pages []HugepagePage `xml:"page"`
+}
+
+type HugepagePage struct {
+	Size    uint64 `xml:"size,attr"`
+	Unit    string `xml:"unit,attr"`
+	Nodeset string `xml:"nodeset,attr"`
+}
+
+type LaunchSecurity struct {
+	Type   string `xml:"type,attr"`
+	Policy string `xml:"policy"`
+}
+
+type OS struct {
+	Firmware         string            `xml:"firmware,attr"`
+	FirmwareFeatures []FirmwareFeature `xml:"firmware>feature"`
+	Loader           Loader            `xml:"loader"`
+	Boots            []OSBoot          `xml:"boot"`
+}
+
+type OSBoot struct {
+	Dev string `xml:"dev,attr"`
+}
+
+type DeviceBoot struct {
+	Order uint `xml:"order,attr"`
+}
+
+type FirmwareFeature struct {
+	Name    string `xml:"name,attr"`
+	Enabled string `xml:"enabled,attr"`
+}
+
+type Loader struct {
+	Secure string `xml:"secure,attr"`
+}
+
+type CPU struct {
+	Mode     string       `xml:"mode,attr"`
+	Model    CPUModel     `xml:"model"`
+	Features []CPUFeature `xml:"feature"`
+	Topology *CPUTopology `xml:"topology"`
+}
+
+type CPUTopology struct {
+	Sockets uint `xml:"sockets,attr"`
+	Dies    uint `xml:"dies,attr"`
+	Cores   uint `xml:"cores,attr"`
+	Threads uint `xml:"threads,attr"`
+}
+
+type CPUModel struct {
+	Name     string `xml:",chardata"`
+	Fallback string `xml:"fallback,attr"`
+}
+
+type CPUFeature struct {
+	Policy string `xml:"policy,attr"`
+	Name   string `xml:"name,attr"`
+}
+
+type Metadata struct {
+	Elements []MetadataElement `xml:",any"`
+}
+
+type MetadataElement struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr        `xml:",any,attr"`
+	Text     string            `xml:",chardata"`
+	Children []MetadataElement `xml:",any"`
 }
 
 type Devices struct {
+	Emulator   string      `xml:"emulator"`
 	Disks      []Disk      `xml:"disk"`
 	Interfaces []Interface `xml:"interface"`
+	Graphics   []Graphics  `xml:"graphics"`
+	Hostdevs   []Hostdev   `xml:"hostdev"`
+	TPMs       []TPM       `xml:"tpm"`
+	Channels   []Channel   `xml:"channel"`
+	RNGs       []RNG       `xml:"rng"`
+	Videos     []Video     `xml:"video"`
+}
+
+type Video struct {
+	Model VideoModel `xml:"model"`
+}
+
+type VideoModel struct {
+	Type  string `xml:"type,attr"`
+	VRAM  uint64 `xml:"vram,attr"`
+	Heads uint   `xml:"heads,attr"`
+}
+
+type RNG struct {
+	Model   string     `xml:"model,attr"`
+	Backend RNGBackend `xml:"backend"`
+}
+
+type RNGBackend struct {
+	Model string `xml:"model,attr"`
+	Type  string `xml:"type,attr"`
+	Path  string `xml:",chardata"`
+}
+
+type Channel struct {
+	Type   string        `xml:"type,attr"`
+	Target ChannelTarget `xml:"target"`
+}
+
+type ChannelTarget struct {
+	Type  string `xml:"type,attr"`
+	Name  string `xml:"name,attr"`
+	State string `xml:"state,attr"`
 }
 
 type Disk struct {
-	Device   string     `xml:"device,attr"`
-	Source   DiskSource `xml:"source"`
-	Target   DiskTarget `xml:"target"`
-	DiskType string     `xml:"type,attr"`
+	Device       string        `xml:"device,attr"`
+	Source       DiskSource    `xml:"source"`
+	Target       DiskTarget    `xml:"target"`
+	DiskType     string        `xml:"type,attr"`
+	BackingStore *BackingStore `xml:"backingStore"`
+	Alias        DiskAlias     `xml:"alias"`
+	Driver       DiskDriver    `xml:"driver"`
+	BlockIO      DiskBlockIO   `xml:"blockio"`
+	Serial       string        `xml:"serial"`
+	Boot         *DeviceBoot   `xml:"boot"`
+	ReadOnly     *struct{}     `xml:"readonly"`
+	Shareable    *struct{}     `xml:"shareable"`
+}
+
+type DiskBlockIO struct {
+	LogicalBlockSize  uint `xml:"logical_block_size,attr"`
+	PhysicalBlockSize uint `xml:"physical_block_size,attr"`
+}
+
+type DiskDriver struct {
+	Name    string `xml:"name,attr"`
+	Type    string `xml:"type,attr"`
+	Cache   string `xml:"cache,attr"`
+	IO      string `xml:"io,attr"`
+	Discard string `xml:"discard,attr"`
+}
+
+type DiskAlias struct {
+	Name string `xml:"name,attr"`
+}
+
+type BackingStore struct {
+	Type         string        `xml:"type,attr"`
+	Format       DiskFormat    `xml:"format"`
+	Source       DiskSource    `xml:"source"`
+	BackingStore *BackingStore `xml:"backingStore"`
+}
+
+type DiskFormat struct {
+	Type string `xml:"type,attr"`
 }
 
 type DiskSource struct {
@@ -39,9 +229,16 @@ type DiskTarget struct {
 }
 
 type Interface struct {
+	Type        string               `xml:"type,attr"`
 	Source      InterfaceSource      `xml:"source"`
 	Target      InterfaceTarget      `xml:"target"`
 	Virtualport InterfaceVirtualPort `xml:"virtualport"`
+	Link        InterfaceLink        `xml:"link"`
+	Boot        *DeviceBoot          `xml:"boot"`
+}
+
+type InterfaceLink struct {
+	State string `xml:"state,attr"`
 }
 
 type InterfaceVirtualPort struct {
@@ -53,19 +250,89 @@ type InterfaceVirtualPortParam struct {
 
 type InterfaceSource struct {
 	Bridge string `xml:"bridge,attr"`
+	Path   string `xml:"path,attr"`
+	Mode   string `xml:"mode,attr"`
 }
 
 type InterfaceTarget struct {
 	Device string `xml:"dev,attr"`
 }
 
+type Graphics struct {
+	Type string `xml:"type,attr"`
+	Port int    `xml:"port,attr"`
+}
+
+type TPM struct {
+	Model   string     `xml:"model,attr"`
+	Backend TPMBackend `xml:"backend"`
+}
+
+type TPMBackend struct {
+	Type    string `xml:"type,attr"`
+	Version string `xml:"version,attr"`
+}
+
+type Hostdev struct {
+	Type   string        `xml:"type,attr"`
+	Source HostdevSource `xml:"source"`
+	Boot   *DeviceBoot   `xml:"boot"`
+}
+
+type HostdevSource struct {
+	Address HostdevAddress `xml:"address"`
+}
+
+type HostdevAddress struct {
+	Domain   string `xml:"domain,attr"`
+	Bus      string `xml:"bus,attr"`
+	Slot     string `xml:"slot,attr"`
+	Function string `xml:"function,attr"`
+	UUID     string `xml:"uuid,attr"`
+}
+
+type DomainCapabilities struct {
+	Path    string                 `xml:"path"`
+	Domain  string                 `xml:"domain"`
+	Machine string                 `xml:"machine"`
+	Arch    string                 `xml:"arch"`
+	VCPU    DomainCapabilitiesVCPU `xml:"vcpu"`
+}
+
+type DomainCapabilitiesVCPU struct {
+	Max int `xml:"max,attr"`
+}
+
+type Capabilities struct {
+	Guests []CapabilitiesGuest `xml:"guest"`
+}
+
+type CapabilitiesGuest struct {
+	OSType string                `xml:"os_type"`
+	Arch   CapabilitiesGuestArch `xml:"arch"`
+}
+
+type CapabilitiesGuestArch struct {
+	Name     string                `xml:"name,attr"`
+	Machines []CapabilitiesMachine `xml:"machine"`
+}
+
+type CapabilitiesMachine struct {
+	Name    string `xml:",chardata"`
+	MaxCpus int    `xml:"maxCpus,attr"`
+}
+
 type VirDomainMemoryStats struct {
-	MajorFault    uint64
-	MinorFault    uint64
-	Unused        uint64
-	Available     uint64
-	ActualBalloon uint64
-	Rss           uint64
-	Usable        uint64
-	DiskCaches    uint64
+	MajorFault     uint64
+	MinorFault     uint64
+	Unused         uint64
+	Available      uint64
+	ActualBalloon  uint64
+	Rss            uint64
+	Usable         uint64
+	DiskCaches     uint64
+	SwapIn         uint64
+	SwapOut        uint64
+	HugetlbPgAlloc uint64
+	HugetlbPgFail  uint64
 }